@@ -0,0 +1,239 @@
+package buffer
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+var (
+	ErrTooLong  = errors.New("value too long for its length prefix")
+	ErrReserved = errors.New("reserved bytes out of range")
+)
+
+// binary helpers for hand-rolled protocols
+// order is binary.LittleEndian or binary.BigEndian
+// readers return io.ErrUnexpectedEOF when the buffer runs short
+
+func (buf *Buffer) WriteUint8(v uint8) { buf.WriteByte(v) }
+
+func (buf *Buffer) WriteUint16(order binary.ByteOrder, v uint16) {
+	var b [2]byte
+	order.PutUint16(b[:], v)
+	buf.Write(b[:])
+}
+
+func (buf *Buffer) WriteUint32(order binary.ByteOrder, v uint32) {
+	var b [4]byte
+	order.PutUint32(b[:], v)
+	buf.Write(b[:])
+}
+
+func (buf *Buffer) WriteUint64(order binary.ByteOrder, v uint64) {
+	var b [8]byte
+	order.PutUint64(b[:], v)
+	buf.Write(b[:])
+}
+
+func (buf *Buffer) WriteInt8(v int8)                           { buf.WriteUint8(uint8(v)) }
+func (buf *Buffer) WriteInt16(order binary.ByteOrder, v int16) { buf.WriteUint16(order, uint16(v)) }
+func (buf *Buffer) WriteInt32(order binary.ByteOrder, v int32) { buf.WriteUint32(order, uint32(v)) }
+func (buf *Buffer) WriteInt64(order binary.ByteOrder, v int64) { buf.WriteUint64(order, uint64(v)) }
+
+func (buf *Buffer) WriteFloat32(order binary.ByteOrder, v float32) {
+	buf.WriteUint32(order, math.Float32bits(v))
+}
+
+func (buf *Buffer) WriteFloat64(order binary.ByteOrder, v float64) {
+	buf.WriteUint64(order, math.Float64bits(v))
+}
+
+func (buf *Buffer) WriteUvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (buf *Buffer) WriteVarint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+// WriteVarBytes b prefixed by its uvarint length
+func (buf *Buffer) WriteVarBytes(b []byte) {
+	buf.WriteUvarint(uint64(len(b)))
+	buf.Write(b)
+}
+
+func (buf *Buffer) WriteVarString(s string) {
+	buf.WriteUvarint(uint64(len(s)))
+	buf.WriteString(s)
+}
+
+// WriteBytes16 b prefixed by its uint16 length
+func (buf *Buffer) WriteBytes16(order binary.ByteOrder, b []byte) error {
+	if len(b) > math.MaxUint16 {
+		return ErrTooLong
+	}
+	buf.WriteUint16(order, uint16(len(b)))
+	buf.Write(b)
+	return nil
+}
+
+func (buf *Buffer) WriteString16(order binary.ByteOrder, s string) error {
+	if len(s) > math.MaxUint16 {
+		return ErrTooLong
+	}
+	buf.WriteUint16(order, uint16(len(s)))
+	buf.WriteString(s)
+	return nil
+}
+
+// Reserve append n zero bytes, typically a length header, and return their offset
+// fill them with Reserved once the rest is written, as long as nothing was read
+func (buf *Buffer) Reserve(n int) int {
+	off := buf.Len()
+	buf.Write(make([]byte, n))
+	return off
+}
+
+// Reserved the n bytes at off returned by Reserve
+func (buf *Buffer) Reserved(off, n int) ([]byte, error) {
+	if off < 0 || n < 0 || off+n > buf.Len() {
+		return nil, ErrReserved
+	}
+	return buf.Bytes()[off : off+n], nil
+}
+
+// PatchUint16 PatchUint32 back-patch a reserved length header
+func (buf *Buffer) PatchUint16(off int, order binary.ByteOrder, v uint16) error {
+	b, err := buf.Reserved(off, 2)
+	if err == nil {
+		order.PutUint16(b, v)
+	}
+	return err
+}
+
+func (buf *Buffer) PatchUint32(off int, order binary.ByteOrder, v uint32) error {
+	b, err := buf.Reserved(off, 4)
+	if err == nil {
+		order.PutUint32(b, v)
+	}
+	return err
+}
+
+func (buf *Buffer) next(n int) ([]byte, error) {
+	if buf.Len() < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf.Next(n), nil
+}
+
+func (buf *Buffer) ReadUint8() (uint8, error) {
+	b, err := buf.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (buf *Buffer) ReadUint16(order binary.ByteOrder) (uint16, error) {
+	b, err := buf.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return order.Uint16(b), nil
+}
+
+func (buf *Buffer) ReadUint32(order binary.ByteOrder) (uint32, error) {
+	b, err := buf.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return order.Uint32(b), nil
+}
+
+func (buf *Buffer) ReadUint64(order binary.ByteOrder) (uint64, error) {
+	b, err := buf.next(8)
+	if err != nil {
+		return 0, err
+	}
+	return order.Uint64(b), nil
+}
+
+func (buf *Buffer) ReadInt8() (int8, error) {
+	v, err := buf.ReadUint8()
+	return int8(v), err
+}
+
+func (buf *Buffer) ReadInt16(order binary.ByteOrder) (int16, error) {
+	v, err := buf.ReadUint16(order)
+	return int16(v), err
+}
+
+func (buf *Buffer) ReadInt32(order binary.ByteOrder) (int32, error) {
+	v, err := buf.ReadUint32(order)
+	return int32(v), err
+}
+
+func (buf *Buffer) ReadInt64(order binary.ByteOrder) (int64, error) {
+	v, err := buf.ReadUint64(order)
+	return int64(v), err
+}
+
+func (buf *Buffer) ReadFloat32(order binary.ByteOrder) (float32, error) {
+	v, err := buf.ReadUint32(order)
+	return math.Float32frombits(v), err
+}
+
+func (buf *Buffer) ReadFloat64(order binary.ByteOrder) (float64, error) {
+	v, err := buf.ReadUint64(order)
+	return math.Float64frombits(v), err
+}
+
+func (buf *Buffer) ReadUvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func (buf *Buffer) ReadVarint() (int64, error) {
+	v, err := binary.ReadVarint(buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+// ReadVarBytes the returned bytes alias the buffer until the next write
+func (buf *Buffer) ReadVarBytes() ([]byte, error) {
+	n, err := buf.ReadUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(buf.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf.Next(int(n)), nil
+}
+
+func (buf *Buffer) ReadVarString() (string, error) {
+	b, err := buf.ReadVarBytes()
+	return string(b), err
+}
+
+// ReadBytes16 the returned bytes alias the buffer until the next write
+func (buf *Buffer) ReadBytes16(order binary.ByteOrder) ([]byte, error) {
+	n, err := buf.ReadUint16(order)
+	if err != nil {
+		return nil, err
+	}
+	return buf.next(int(n))
+}
+
+func (buf *Buffer) ReadString16(order binary.ByteOrder) (string, error) {
+	b, err := buf.ReadBytes16(order)
+	return string(b), err
+}
@@ -0,0 +1,52 @@
+package buffer
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestBinary(t *testing.T) {
+	b := NewBuffer()
+	off := b.Reserve(2)
+	b.WriteUint8(7)
+	b.WriteInt16(binary.BigEndian, -2)
+	b.WriteUint32(binary.LittleEndian, 0xdeadbeef)
+	b.WriteInt64(binary.BigEndian, -1<<40)
+	b.WriteFloat32(binary.LittleEndian, 1.5)
+	b.WriteFloat64(binary.BigEndian, -2.25)
+	b.WriteUvarint(300)
+	b.WriteVarint(-300)
+	b.WriteVarString("ego")
+	if err := b.WriteString16(binary.BigEndian, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.PatchUint16(off, binary.LittleEndian, uint16(b.Len())); err != nil {
+		t.Fatal(err)
+	}
+
+	n, _ := b.ReadUint16(binary.LittleEndian)
+	u8, _ := b.ReadUint8()
+	i16, _ := b.ReadInt16(binary.BigEndian)
+	u32, _ := b.ReadUint32(binary.LittleEndian)
+	i64, _ := b.ReadInt64(binary.BigEndian)
+	f32, _ := b.ReadFloat32(binary.LittleEndian)
+	f64, _ := b.ReadFloat64(binary.BigEndian)
+	uv, _ := b.ReadUvarint()
+	v, _ := b.ReadVarint()
+	vs, _ := b.ReadVarString()
+	s16, err := b.ReadString16(binary.BigEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 44 || u8 != 7 || i16 != -2 || u32 != 0xdeadbeef || i64 != -1<<40 ||
+		f32 != 1.5 || f64 != -2.25 || uv != 300 || v != -300 || vs != "ego" || s16 != "hello" {
+		t.Errorf("read back %v %v %v %x %v %v %v %v %v %q %q", n, u8, i16, u32, i64, f32, f64, uv, v, vs, s16)
+	}
+	if _, err := b.ReadUint32(binary.BigEndian); err != io.ErrUnexpectedEOF {
+		t.Errorf("err %v want %v", err, io.ErrUnexpectedEOF)
+	}
+	if err := b.PatchUint32(0, binary.BigEndian, 1); err != ErrReserved {
+		t.Errorf("err %v want %v", err, ErrReserved)
+	}
+}
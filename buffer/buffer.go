@@ -2,30 +2,74 @@ package buffer
 
 import (
 	"bytes"
+	"errors"
 	"sync/atomic"
 	"time"
 )
 
+var ErrRefCount = errors.New("buffer released more than referenced")
+
+var (
+	strict      int32
+	badReleases uint64
+)
+
+// SetStrict panic with ErrRefCount on a Done without a matching reference
+// otherwise it is only counted, see BadReleases
+func SetStrict(on bool) {
+	v := int32(0)
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&strict, v)
+}
+
+// BadReleases number of Done calls without a matching reference
+func BadReleases() uint64 { return atomic.LoadUint64(&badReleases) }
+
 type Buffer struct {
 	*bytes.Buffer
 	Encrypt bool
 	counter int32
+
+	// pool the buffer goes back to when the last reference is released
+	pool *Pool
 }
 
+// Reset clear the content, references are kept
 func (buf *Buffer) Reset() {
 	buf.Buffer.Reset()
 	buf.Encrypt = true
-	atomic.StoreInt32(&buf.counter, 0)
 }
 
 func (buf *Buffer) Add(n uint32) {
 	atomic.AddInt32(&buf.counter, int32(n))
 }
 
+// Refs current references
+func (buf *Buffer) Refs() int32 { return atomic.LoadInt32(&buf.counter) }
+
+// Done release one reference, the last one returns a pooled buffer to its pool
 func (buf *Buffer) Done() {
-	atomic.AddInt32(&buf.counter, -1)
+	n := atomic.AddInt32(&buf.counter, -1)
+	if n > 0 {
+		return
+	}
+	if n < 0 {
+		atomic.AddInt32(&buf.counter, 1)
+		atomic.AddUint64(&badReleases, 1)
+		if atomic.LoadInt32(&strict) == 1 {
+			panic(ErrRefCount)
+		}
+		return
+	}
+	if buf.pool != nil {
+		buf.pool.put(buf)
+	}
 }
 
+// GC wait up to maxTime for every reference released
+// pooled buffers need no GC, Done returns them
 func (buf *Buffer) GC(maxTime time.Duration) bool {
 	start := time.Now()
 	for {
@@ -40,6 +84,13 @@ func (buf *Buffer) GC(maxTime time.Duration) bool {
 	return false
 }
 
+func newSizedBuffer(size int) *Buffer {
+	return &Buffer{
+		Buffer:  bytes.NewBuffer(make([]byte, 0, size)),
+		Encrypt: true,
+	}
+}
+
 func NewBuffer() *Buffer {
 	return &Buffer{
 		Buffer:  bytes.NewBufferString(""),
@@ -1,62 +1,254 @@
 package buffer
 
 import (
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/zerak/ego/metrics"
 )
 
 const (
 	MaxGCTime = time.Second
+
+	// MinClassSize MaxClassSize size classes are the powers of 2 in between
+	MinClassSize = 64
+	MaxClassSize = 64 << 10
+
+	// DefaultClassSize the class Get takes buffers from
+	DefaultClassSize = 512
+
+	// DefaultPoolSize idle buffers kept per class when NewPool is given none
+	DefaultPoolSize = 128
 )
 
+// hits and misses over every pool, Stats has them per pool
+var (
+	poolHits = metrics.NewCounter("ego_buffer_pool_hits_total",
+		"Buffers got from a pool free list.")
+	poolMisses = metrics.NewCounter("ego_buffer_pool_misses_total",
+		"Buffers a pool had to allocate.")
+)
+
+// PoolStats counters of a Pool
+type PoolStats struct {
+	Gets   uint64
+	Puts   uint64
+	Misses uint64 // Gets served by a new buffer
+	Drops  uint64 // Puts not kept, class full or capacity over the cap
+	Live   int64  // buffers got and not returned yet
+
+	// Retained bytes of capacity held by idle buffers
+	Retained int64
+}
+
+// Pool free lists of buffers by capacity class
+// buffers go back when their last reference is released, nothing polls
+// a class keeps at most maxSize idle buffers
+// buffers grown beyond MaxCap are dropped so one huge frame is not held forever
 type Pool struct {
-	pool       *sync.Pool
-	collection chan *Buffer
+	MaxCap int
+
+	classes []chan *Buffer
+
+	gets     uint64
+	puts     uint64
+	misses   uint64
+	drops    uint64
+	live     int64
+	retained int64
+
+	leaksMu sync.Mutex
+	leaks   map[*Buffer]Leak
+	stack   bool
 }
 
-func (p *Pool) Get() (buf *Buffer, fromPool bool) {
-	bufObj := p.pool.Get()
-	if bufObj == nil {
-		buf = NewBuffer()
-	} else {
-		fromPool = true
-		buf = bufObj.(*Buffer)
-		buf.Reset()
+// Leak a buffer got from the pool and never released
+type Leak struct {
+	Buffer *Buffer
+	Since  time.Time
+	// Stack of the Get, only when tracked with stacks
+	Stack string
+}
+
+// TrackLeaks remember every buffer got until it is returned, for tests
+// stack captures the caller of Get, which is slow
+func (p *Pool) TrackLeaks(stack bool) {
+	p.leaksMu.Lock()
+	defer p.leaksMu.Unlock()
+	p.leaks = make(map[*Buffer]Leak)
+	p.stack = stack
+}
+
+// Leaks buffers still referenced since they were got
+// only known when TrackLeaks is on
+func (p *Pool) Leaks() []Leak {
+	p.leaksMu.Lock()
+	defer p.leaksMu.Unlock()
+	list := make([]Leak, 0, len(p.leaks))
+	for _, l := range p.leaks {
+		list = append(list, l)
 	}
-	return
+	return list
 }
 
-func (p *Pool) Put(buf *Buffer, fromPool bool) {
-	if fromPool && buf != nil {
+func (p *Pool) track(buf *Buffer) {
+	p.leaksMu.Lock()
+	defer p.leaksMu.Unlock()
+	if p.leaks == nil {
+		return
+	}
+	l := Leak{Buffer: buf, Since: time.Now()}
+	if p.stack {
+		b := make([]byte, 4096)
+		l.Stack = string(b[:runtime.Stack(b, false)])
+	}
+	p.leaks[buf] = l
+}
+
+func (p *Pool) untrack(buf *Buffer) {
+	p.leaksMu.Lock()
+	defer p.leaksMu.Unlock()
+	if p.leaks != nil {
+		delete(p.leaks, buf)
+	}
+}
+
+// classOf smallest class whose buffers hold n bytes, -1 when n is over every class
+func classOf(n int) int {
+	c, size := 0, MinClassSize
+	for size < n {
+		if size >= MaxClassSize {
+			return -1
+		}
+		c++
+		size <<= 1
+	}
+	return c
+}
+
+// classFor largest class a buffer of capacity n can serve, -1 when too small
+func classFor(n int) int {
+	if n < MinClassSize {
+		return -1
+	}
+	c, size := 0, MinClassSize
+	for size<<1 <= n && size < MaxClassSize {
+		c++
+		size <<= 1
+	}
+	return c
+}
+
+// Get a buffer of DefaultClassSize
+func (p *Pool) Get() (buf *Buffer, fromPool bool) {
+	return p.GetSize(DefaultClassSize)
+}
+
+// GetSize a buffer holding at least n bytes without growing
+// it holds one reference, the last Done returns it to the pool
+func (p *Pool) GetSize(n int) (buf *Buffer, fromPool bool) {
+	atomic.AddUint64(&p.gets, 1)
+	c := classOf(n)
+	if c >= 0 {
 		select {
-		case p.collection <- buf:
+		case buf = <-p.classes[c]:
+			atomic.AddInt64(&p.retained, -int64(buf.Cap()))
+			buf.Reset()
+			fromPool = true
+			poolHits.Inc()
 		default:
-			// put buffer fail
-			// this case will use temporary obj
-			// and may cause memory fragmentation
 		}
+	} else {
+		c = len(p.classes) - 1
 	}
+	if buf == nil {
+		atomic.AddUint64(&p.misses, 1)
+		poolMisses.Inc()
+		size := MinClassSize << uint(c)
+		if size < n {
+			size = n
+		}
+		buf = newSizedBuffer(size)
+	}
+	buf.pool = p
+	atomic.StoreInt32(&buf.counter, 1)
+	atomic.AddInt64(&p.live, 1)
+	p.track(buf)
+	return buf, fromPool
 }
 
-func (p *Pool) run() {
-	for buf := range p.collection {
-		if buf.GC(MaxGCTime) {
-			p.pool.Put(buf)
+// Put release the reference taken by Get, same as Done
+// a buffer not got from a pool is adopted once unreferenced
+// fromPool is kept for compatibility
+func (p *Pool) Put(buf *Buffer, fromPool bool) {
+	if buf == nil {
+		return
+	}
+	if buf.pool == nil {
+		buf.pool = p
+		if buf.Refs() == 0 {
+			atomic.AddInt64(&p.live, 1)
+			p.put(buf)
 		}
+		return
+	}
+	buf.Done()
+}
+
+func (p *Pool) put(buf *Buffer) {
+	atomic.AddUint64(&p.puts, 1)
+	atomic.AddInt64(&p.live, -1)
+	p.untrack(buf)
+	n := buf.Cap()
+	c := classFor(n)
+	if c < 0 || (p.MaxCap > 0 && n > p.MaxCap) {
+		atomic.AddUint64(&p.drops, 1)
+		return
+	}
+	select {
+	case p.classes[c] <- buf:
+		atomic.AddInt64(&p.retained, int64(n))
+	default:
+		atomic.AddUint64(&p.drops, 1)
+	}
+}
+
+func (p *Pool) Stats() PoolStats {
+	return PoolStats{
+		Gets:     atomic.LoadUint64(&p.gets),
+		Puts:     atomic.LoadUint64(&p.puts),
+		Misses:   atomic.LoadUint64(&p.misses),
+		Drops:    atomic.LoadUint64(&p.drops),
+		Live:     atomic.LoadInt64(&p.live),
+		Retained: atomic.LoadInt64(&p.retained),
 	}
 }
 
+// NewPool keep up to maxSize idle buffers in each size class
+// maxSize <= 0 means DefaultPoolSize
+// initSize buffers of DefaultClassSize are allocated up front, in that class only
+// maxSize is raised to initSize so they all fit
 func NewPool(initSize, maxSize int) *Pool {
+	if maxSize <= 0 {
+		maxSize = DefaultPoolSize
+	}
 	if maxSize < initSize {
 		maxSize = initSize
 	}
 	p := &Pool{
-		pool:       &sync.Pool{New: func() interface{} { return NewBuffer() }},
-		collection: make(chan *Buffer, maxSize),
+		MaxCap:  MaxClassSize << 1,
+		classes: make([]chan *Buffer, classOf(MaxClassSize)+1),
+	}
+	for i := range p.classes {
+		p.classes[i] = make(chan *Buffer, maxSize)
 	}
 	for i := 0; i < initSize; i++ {
-		p.pool.Put(p.pool.New())
+		b := newSizedBuffer(DefaultClassSize)
+		b.pool = p
+		p.classes[classOf(DefaultClassSize)] <- b
+		atomic.AddInt64(&p.retained, int64(b.Cap()))
 	}
-	go p.run()
 	return p
 }
@@ -0,0 +1,99 @@
+package buffer
+
+import (
+	"testing"
+)
+
+func TestPoolClasses(t *testing.T) {
+	p := NewPool(0, 2)
+	b, fromPool := p.GetSize(1000)
+	if fromPool || b.Cap() < 1000 {
+		t.Fatalf("first get fromPool %v cap %v", fromPool, b.Cap())
+	}
+	p.Put(b, fromPool)
+	if s := p.Stats(); s.Retained != int64(b.Cap()) || s.Puts != 1 {
+		t.Errorf("stats %+v", s)
+	}
+	if b2, ok := p.GetSize(1024); !ok || b2 != b {
+		t.Errorf("same class buffer not reused")
+	}
+	if _, ok := p.GetSize(100); ok {
+		t.Errorf("small class served from empty list")
+	}
+
+	huge := newSizedBuffer(p.MaxCap + 1)
+	p.Put(huge, true)
+	if s := p.Stats(); s.Drops != 1 || s.Retained != 0 || s.Misses != 2 || s.Gets != 3 {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+func TestPoolRefcount(t *testing.T) {
+	p := NewPool(0, 2)
+	b, _ := p.Get()
+	b.Add(2)
+	p.Put(b, true)
+	if p.Stats().Puts != 0 {
+		t.Fatal("referenced buffer returned")
+	}
+	b.Done()
+	b.Done()
+	if s := p.Stats(); s.Puts != 1 || s.Retained == 0 {
+		t.Errorf("buffer not returned by last Done %+v", s)
+	}
+}
+
+func TestPoolRelease(t *testing.T) {
+	p := NewPool(0, 2)
+	p.TrackLeaks(true)
+	b, _ := p.Get()
+	kept, _ := p.Get()
+	b.Done()
+	if s := p.Stats(); s.Puts != 1 || s.Live != 1 {
+		t.Errorf("stats %+v", s)
+	}
+
+	bad := BadReleases()
+	b.Done()
+	if BadReleases() != bad+1 || b.Refs() != 0 || p.Stats().Puts != 1 {
+		t.Errorf("double release not detected")
+	}
+	SetStrict(true)
+	func() {
+		defer func() {
+			if v := recover(); v != ErrRefCount {
+				t.Errorf("recovered %v want %v", v, ErrRefCount)
+			}
+		}()
+		b.Done()
+	}()
+	SetStrict(false)
+
+	leaks := p.Leaks()
+	if len(leaks) != 1 || leaks[0].Buffer != kept || leaks[0].Stack == "" {
+		t.Errorf("leaks %+v", leaks)
+	}
+	kept.Done()
+	if len(p.Leaks()) != 0 {
+		t.Errorf("released buffer still reported")
+	}
+}
+
+func TestPoolDefaultSize(t *testing.T) {
+	p := NewPool(0, 0)
+	b, _ := p.Get()
+	b.Done()
+	if s := p.Stats(); s.Drops != 0 || s.Retained == 0 {
+		t.Errorf("buffer not kept by a pool without max size %+v", s)
+	}
+	if _, ok := p.Get(); !ok {
+		t.Error("kept buffer not reused")
+	}
+
+	p = NewPool(4, 2)
+	for i := 0; i < 4; i++ {
+		if _, ok := p.Get(); !ok {
+			t.Fatalf("initial buffer %v not pooled", i)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"path/filepath"
+	"time"
 
 	"github.com/zerak/goconf"
 )
@@ -27,6 +30,78 @@ type Server struct {
 	// addr ip:port
 	Addr string `ego:"server:addr"`
 
+	// network tcp4 tcp6 tcp(dual stack) unix, default tcp4
+	// unix listens on the socket file path in addr
+	Network string `ego:"server:network"`
+
+	// tcp_delay enable nagle, TCP_NODELAY is set by default
+	TcpDelay bool `ego:"server:tcp_delay"`
+
+	// keepalive 30s, 0 system default, negative disable
+	KeepAlive time.Duration `ego:"server:keepalive:time"`
+
+	// rcvbuf sndbuf 256k, 0 system default
+	ReadBuffer  int `ego:"server:rcvbuf:memory"`
+	WriteBuffer int `ego:"server:sndbuf:memory"`
+
+	// reuseport number of SO_REUSEPORT accept loops
+	ReusePort int `ego:"server:reuseport"`
+
+	// proxy_protocol parse PROXY v1/v2 headers from proxy_trusted peers
+	// proxy_trusted cidr list, required when proxy_protocol is on
+	ProxyProtocol bool          `ego:"server:proxy_protocol"`
+	ProxyTrusted  []string      `ego:"server:proxy_trusted:,"`
+	ProxyTimeout  time.Duration `ego:"server:proxy_timeout:time"`
+
+	// max_conns max_conns_per_ip 0 means unlimited
+	MaxConns      int `ego:"server:max_conns"`
+	MaxConnsPerIP int `ego:"server:max_conns_per_ip"`
+
+	// accept_rate accepts per second, accept_burst default accept_rate
+	AcceptRate  int `ego:"server:accept_rate"`
+	AcceptBurst int `ego:"server:accept_burst"`
+
+	// allow deny cidr list 10.0.0.0/8,192.168.1.1
+	Allow []string `ego:"server:allow:,"`
+	Deny  []string `ego:"server:deny:,"`
+
+	// max_frames max_bytes inbound per second of a session, 0 means unlimited
+	// flood_action delay/drop/disconnect
+	MaxFrames   int    `ego:"server:max_frames"`
+	MaxBytes    int    `ego:"server:max_bytes"`
+	FloodAction string `ego:"server:flood_action"`
+
+	// compress algorithms a session may negotiate zstd,snappy,deflate, empty allows all
+	// compress_threshold frames smaller than it are sent uncompressed
+	Compress          []string `ego:"server:compress:,"`
+	CompressThreshold int      `ego:"server:compress_threshold"`
+
+	// dispatch inline/session/pool/loop where frames are handled
+	// dispatch_workers goroutines of the pool, dispatch_queue frames queued per goroutine
+	Dispatch        string `ego:"server:dispatch"`
+	DispatchWorkers int    `ego:"server:dispatch_workers"`
+	DispatchQueue   int    `ego:"server:dispatch_queue"`
+
+	// drain_timeout max time stop waits for sessions to end before closing them, 10s by default
+	// keep it below the stop timeout of the lifecycle, e.g. drain on restart
+	DrainTimeout time.Duration `ego:"server:drain_timeout:time"`
+
+	// [http]
+	// addr ip:port of the http service
+	// read_timeout write_timeout idle_timeout 10s, 0 means none
+	HttpAddr         string        `ego:"http:addr"`
+	HttpReadTimeout  time.Duration `ego:"http:read_timeout:time"`
+	HttpWriteTimeout time.Duration `ego:"http:write_timeout:time"`
+	HttpIdleTimeout  time.Duration `ego:"http:idle_timeout:time"`
+
+	// [admin]
+	// addr ip:port of the admin endpoint, keep it private, empty disables it
+	// allow cidr list of the clients, token required as "Authorization: Bearer <token>"
+	// an addr not on loopback needs allow or token
+	AdminAddr  string   `ego:"admin:addr"`
+	AdminAllow []string `ego:"admin:allow:,"`
+	AdminToken string   `ego:"admin:token"`
+
 	// [db]
 	// mysql mysql01=ip:port,mysql02=ip2:port2
 	Db map[string]string `ego:"db:mysql:,"`
@@ -39,6 +114,16 @@ type Server struct {
 func (s Server) String() string {
 	str := fmt.Sprintf("log path:[%v/%v] level:[%v] ", s.LogRoot, s.LogName, s.LogLevel)
 	str += fmt.Sprintf("server addr:[%v] mod:%v ", s.Addr, s.DevMod)
+	str += fmt.Sprintf("network:[%v] tcp delay:%v keepalive:%v buffer:[%v/%v] reuseport:%v ",
+		s.Network, s.TcpDelay, s.KeepAlive, s.ReadBuffer, s.WriteBuffer, s.ReusePort)
+	str += fmt.Sprintf("proxy protocol:%v trusted:%v ", s.ProxyProtocol, s.ProxyTrusted)
+	str += fmt.Sprintf("max conns:[%v/%v] accept rate:[%v/%v] allow:%v deny:%v ",
+		s.MaxConns, s.MaxConnsPerIP, s.AcceptRate, s.AcceptBurst, s.Allow, s.Deny)
+	str += fmt.Sprintf("session limit:[%v frames %v bytes %v] ", s.MaxFrames, s.MaxBytes, s.FloodAction)
+	str += fmt.Sprintf("compress:%v threshold:%v ", s.Compress, s.CompressThreshold)
+	str += fmt.Sprintf("dispatch:%v workers:[%v/%v] ", s.Dispatch, s.DispatchWorkers, s.DispatchQueue)
+	str += fmt.Sprintf("http addr:[%v] timeout:[%v/%v/%v] ", s.HttpAddr, s.HttpReadTimeout, s.HttpWriteTimeout, s.HttpIdleTimeout)
+	str += fmt.Sprintf("admin addr:[%v] allow:%v ", s.AdminAddr, s.AdminAllow)
 	str += fmt.Sprintf("Db:")
 	for k, v := range s.Db {
 		str += fmt.Sprintf("[%v]:[%v] ", k, v)
@@ -50,8 +135,13 @@ func (s Server) String() string {
 	return str
 }
 
+var ErrNoConfigFile = errors.New("config not loaded from a file")
+
 // Get get section config as string
 func (s *Server) Get(section string, tag string) (string, error) {
+	if s.conf == nil {
+		return "", ErrNoConfigFile
+	}
 	sec := s.conf.Get(section)
 	if sec == nil {
 		return "", fmt.Errorf("invalid section:%v", section)
@@ -61,6 +151,9 @@ func (s *Server) Get(section string, tag string) (string, error) {
 
 // GetInt get section config as int
 func (s *Server) GetInt(section string, tag string) (int64, error) {
+	if s.conf == nil {
+		return 0, ErrNoConfigFile
+	}
 	sec := s.conf.Get(section)
 	if sec == nil {
 		return 0, fmt.Errorf("invalid section:%v", section)
@@ -71,46 +164,65 @@ func (s *Server) GetInt(section string, tag string) (int64, error) {
 // Opt the default server config
 var Opt Server
 
-// Init load init config file
+// Init load init config file into Opt, panic on error
 func Init(path string) {
-	Opt.conf = goconf.New()
-	absPath, _ := filepath.Abs(path)
-	err := Opt.conf.Parse(absPath)
+	s, err := Load(path)
 	if err != nil {
 		panic(err)
 	}
-	err = Opt.conf.Unmarshal(&Opt, "ego")
-	if err != nil {
-		panic(err)
+	Opt = s
+}
+
+// Load parse a config file
+func Load(path string) (Server, error) {
+	conf := goconf.New()
+	absPath, _ := filepath.Abs(path)
+	if err := conf.Parse(absPath); err != nil {
+		return Server{}, err
+	}
+	return unmarshal(conf)
+}
+
+// LoadReader parse config content
+func LoadReader(r io.Reader) (Server, error) {
+	conf := goconf.New()
+	if err := conf.ParseReader(r); err != nil {
+		return Server{}, err
 	}
-	if Opt.LogRoot == "" {
-		Opt.LogRoot = "../"
+	return unmarshal(conf)
+}
+
+func unmarshal(conf *goconf.Config) (Server, error) {
+	s := Server{conf: conf}
+	if err := conf.Unmarshal(&s, "ego"); err != nil {
+		return Server{}, err
 	}
-	if Opt.LogName == "" {
-		Opt.LogName = "app"
+	s.SetDefaults()
+	return s, nil
+}
+
+// SetDefaults fill the log and mod options left empty
+func (s *Server) SetDefaults() {
+	if s.LogRoot == "" {
+		s.LogRoot = "../"
 	}
-	if Opt.LogLevel == "" {
-		Opt.LogLevel = "debug"
+	if s.LogName == "" {
+		s.LogName = "app"
 	}
-	if Opt.DevMod == "" {
-		Opt.DevMod = "dev"
+	if s.LogLevel == "" {
+		s.LogLevel = "debug"
+	}
+	if s.DevMod == "" {
+		s.DevMod = "dev"
 	}
 }
 
 // Get get special section config as string
 func Get(section string, tag string) (string, error) {
-	sec := Opt.conf.Get(section)
-	if sec == nil {
-		return "", fmt.Errorf("invalid section:%v", section)
-	}
-	return sec.String(tag)
+	return Opt.Get(section, tag)
 }
 
 // GetInt get special section config as int
 func GetInt(section string, tag string) (int64, error) {
-	sec := Opt.conf.Get(section)
-	if sec == nil {
-		return 0, fmt.Errorf("invalid section:%v", section)
-	}
-	return sec.Int(tag)
+	return Opt.GetInt(section, tag)
 }
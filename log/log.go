@@ -1,17 +1,43 @@
 package log
 
 import (
+	"sync"
+
 	"github.com/zerak/log"
 
 	"github.com/zerak/ego/config"
 )
 
 func Init() {
-	level, _ := log.ParseLevel(config.Opt.LogLevel)
-	defer log.Uninit(log.InitMultiFileAndColoredConsole(config.Opt.LogRoot, config.Opt.LogName, level))
+	InitWith(config.Opt)
+}
+
+var (
+	mu      sync.Mutex
+	current *config.Server
+)
+
+// InitWith init log from conf instead of the global config
+func InitWith(conf config.Server) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = &conf
+	level, _ := log.ParseLevel(conf.LogLevel)
+	defer log.Uninit(log.InitMultiFileAndColoredConsole(conf.LogRoot, conf.LogName, level))
 	log.SetLevel(level)
 }
 
+// Reopen init log again with the last config, so files moved by logrotate are recreated
+// nothing happens before Init
+func Reopen() {
+	mu.Lock()
+	conf := current
+	mu.Unlock()
+	if conf != nil {
+		InitWith(*conf)
+	}
+}
+
 func Trace(format string, arg ...interface{}) {
 	log.Trace(format, arg...)
 }
@@ -0,0 +1,414 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets latency buckets in seconds
+var DefBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry a set of metrics exposed together
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]collector)}
+}
+
+// Default the registry of the New* functions
+var Default = NewRegistry()
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.collectors[c.name()]; ok {
+		panic("metrics: duplicate metric " + c.name())
+	}
+	r.collectors[c.name()] = c
+}
+
+// WriteTo write every metric in the prometheus text format, sorted by name
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	list := make([]collector, 0, len(r.collectors))
+	for _, c := range r.collectors {
+		list = append(list, c)
+	}
+	r.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name() < list[j].name() })
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, c := range list {
+		c.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler serve the registry as text exposition, e.g. on /metrics
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// Handler serve the Default registry
+func Handler() http.Handler { return Default.Handler() }
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+type desc struct {
+	fqName string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) name() string { return d.fqName }
+
+func (d *desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.fqName, escapeHelp(d.help), d.fqName, d.typ)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string { return helpEscaper.Replace(s) }
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labelString {a="1",b="2"} with extra appended, empty without labels
+func labelString(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	n := 0
+	add := func(k, v string) {
+		if n > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(k)
+		sb.WriteString(`="`)
+		sb.WriteString(labelEscaper.Replace(v))
+		sb.WriteByte('"')
+		n++
+	}
+	for i, k := range names {
+		add(k, values[i])
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		add(extra[i], extra[i+1])
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// floatValue a float64 updated atomically
+type floatValue struct {
+	bits uint64
+}
+
+func (f *floatValue) load() float64 { return math.Float64frombits(atomic.LoadUint64(&f.bits)) }
+func (f *floatValue) store(v float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(v))
+}
+func (f *floatValue) add(v float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		n := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&f.bits, old, n) {
+			return
+		}
+	}
+}
+
+// Counter only goes up
+type Counter struct {
+	v floatValue
+}
+
+func (c *Counter) Inc()           { c.v.add(1) }
+func (c *Counter) Add(v float64)  { c.v.add(v) }
+func (c *Counter) Value() float64 { return c.v.load() }
+func (c *Counter) value() float64 { return c.v.load() }
+
+// Gauge goes up and down
+type Gauge struct {
+	v floatValue
+}
+
+func (g *Gauge) Set(v float64)  { g.v.store(v) }
+func (g *Gauge) Add(v float64)  { g.v.add(v) }
+func (g *Gauge) Inc()           { g.v.add(1) }
+func (g *Gauge) Dec()           { g.v.add(-1) }
+func (g *Gauge) Value() float64 { return g.v.load() }
+func (g *Gauge) value() float64 { return g.v.load() }
+
+type valuer interface {
+	value() float64
+}
+
+// vec children by label values
+type vec struct {
+	mu       sync.RWMutex
+	children map[string]interface{}
+	values   map[string][]string
+	newChild func() interface{}
+}
+
+func (v *vec) with(labels int, values []string) interface{} {
+	if len(values) != labels {
+		panic(fmt.Sprintf("metrics: %v label values for %v labels", len(values), labels))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	c, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok = v.children[key]; ok {
+		return c
+	}
+	c = v.newChild()
+	v.children[key] = c
+	v.values[key] = append([]string(nil), values...)
+	return c
+}
+
+// each child sorted by label values
+func (v *vec) each(fn func(values []string, c interface{})) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	v.mu.RUnlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		v.mu.RLock()
+		c, values := v.children[k], v.values[k]
+		v.mu.RUnlock()
+		fn(values, c)
+	}
+}
+
+func newVec(newChild func() interface{}) vec {
+	return vec{children: map[string]interface{}{}, values: map[string][]string{}, newChild: newChild}
+}
+
+func writeVec(w *bufio.Writer, d *desc, v *vec) {
+	d.header(w)
+	v.each(func(values []string, c interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", d.fqName, labelString(d.labels, values), formatFloat(c.(valuer).value()))
+	})
+}
+
+type counterMetric struct {
+	desc
+	vec
+}
+
+type gaugeMetric struct {
+	desc
+	vec
+}
+
+func (c *counterMetric) write(w *bufio.Writer) { writeVec(w, &c.desc, &c.vec) }
+func (g *gaugeMetric) write(w *bufio.Writer)   { writeVec(w, &g.desc, &g.vec) }
+
+// CounterVec counters partitioned by labels
+type CounterVec struct {
+	m *counterMetric
+}
+
+// With the counter of the label values, in label order
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.m.with(len(c.m.labels), values).(*Counter)
+}
+
+// GaugeVec gauges partitioned by labels
+type GaugeVec struct {
+	m *gaugeMetric
+}
+
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return g.m.with(len(g.m.labels), values).(*Gauge)
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	m := &counterMetric{
+		desc: desc{fqName: name, help: help, typ: "counter", labels: labels},
+		vec:  newVec(func() interface{} { return new(Counter) }),
+	}
+	r.register(m)
+	return &CounterVec{m: m}
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	m := &gaugeMetric{
+		desc: desc{fqName: name, help: help, typ: "gauge", labels: labels},
+		vec:  newVec(func() interface{} { return new(Gauge) }),
+	}
+	r.register(m)
+	return &GaugeVec{m: m}
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	return r.NewGaugeVec(name, help).With()
+}
+
+// funcMetric a value read when exposed
+type funcMetric struct {
+	desc
+	fn func() float64
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	f.header(w)
+	fmt.Fprintf(w, "%s %s\n", f.fqName, formatFloat(f.fn()))
+}
+
+// NewGaugeFunc expose fn as a gauge, for values owned elsewhere
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{desc: desc{fqName: name, help: help, typ: "gauge"}, fn: fn})
+}
+
+// NewCounterFunc expose fn as a counter, fn must never decrease
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{desc: desc{fqName: name, help: help, typ: "counter"}, fn: fn})
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	upper  []float64
+	counts []uint64
+	count  uint64
+	sum    floatValue
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v)
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+	h.sum.add(v)
+}
+
+type histogramMetric struct {
+	desc
+	vec
+	buckets []float64
+}
+
+func (m *histogramMetric) write(w *bufio.Writer) {
+	m.header(w)
+	m.each(func(values []string, c interface{}) {
+		h := c.(*Histogram)
+		var cum uint64
+		for i, le := range h.upper {
+			cum += atomic.LoadUint64(&h.counts[i])
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.fqName, labelString(m.labels, values, "le", formatFloat(le)), cum)
+		}
+		count := atomic.LoadUint64(&h.count)
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.fqName, labelString(m.labels, values, "le", "+Inf"), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.fqName, labelString(m.labels, values), formatFloat(h.sum.load()))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.fqName, labelString(m.labels, values), count)
+	})
+}
+
+// HistogramVec histograms partitioned by labels
+type HistogramVec struct {
+	m *histogramMetric
+}
+
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.m.with(len(h.m.labels), values).(*Histogram)
+}
+
+// NewHistogramVec buckets are the sorted upper bounds, nil means DefBuckets
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	m := &histogramMetric{
+		desc:    desc{fqName: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+	}
+	m.vec = newVec(func() interface{} {
+		return &Histogram{upper: m.buckets, counts: make([]uint64, len(m.buckets))}
+	})
+	r.register(m)
+	return &HistogramVec{m: m}
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	return r.NewHistogramVec(name, help, buckets).With()
+}
+
+func NewCounter(name, help string) *Counter { return Default.NewCounter(name, help) }
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labels...)
+}
+func NewGauge(name, help string) *Gauge { return Default.NewGauge(name, help) }
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return Default.NewGaugeVec(name, help, labels...)
+}
+func NewGaugeFunc(name, help string, fn func() float64) { Default.NewGaugeFunc(name, help, fn) }
+func NewCounterFunc(name, help string, fn func() float64) {
+	Default.NewCounterFunc(name, help, fn)
+}
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return Default.NewHistogram(name, help, buckets)
+}
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labels...)
+}
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_requests_total", "Requests.", "code")
+	g := r.NewGauge("test_active", "Active \\ things\nnow.")
+	h := r.NewHistogram("test_seconds", "Latency.", []float64{1, 0.1})
+	r.NewGaugeFunc("test_func", "Func.", func() float64 { return 7 })
+
+	c.With("200").Add(2)
+	c.With("500").Inc()
+	c.With(`a"b`).Inc()
+	g.Set(3)
+	g.Dec()
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var b bytes.Buffer
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_active Active \\ things\nnow.
+# TYPE test_active gauge
+test_active 2
+# HELP test_func Func.
+# TYPE test_func gauge
+test_func 7
+# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{code="200"} 2
+test_requests_total{code="500"} 1
+test_requests_total{code="a\"b"} 1
+# HELP test_seconds Latency.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 5.55
+test_seconds_count 3
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestRegistryPanics(t *testing.T) {
+	r := NewRegistry()
+	v := r.NewCounterVec("x_total", "X.", "a", "b")
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("no panic on label count mismatch")
+			}
+		}()
+		v.With("1")
+	}()
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic on duplicate name")
+		}
+	}()
+	r.NewGauge("x_total", "again")
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("c_total", "C.", "k")
+	g := r.NewGauge("g", "G.")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.With("k").Inc()
+				g.Add(0.5)
+			}
+		}()
+	}
+	wg.Wait()
+	if c.With("k").Value() != 8000 || g.Value() != 4000 {
+		t.Errorf("counter %v gauge %v", c.With("k").Value(), g.Value())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("h_total", "H.").Inc()
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") || !strings.Contains(w.Body.String(), "h_total 1\n") {
+		t.Errorf("content type %q body %q", w.Header().Get("Content-Type"), w.Body.String())
+	}
+}
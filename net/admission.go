@@ -0,0 +1,292 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrDenied        = errors.New("ip denied")
+	ErrRateLimited   = errors.New("accept rate limited")
+	ErrTooManyConns  = errors.New("too many connections")
+	ErrTooManyPerIP  = errors.New("too many connections from ip")
+	ErrInvalidRemote = errors.New("invalid remote address")
+)
+
+// AdmissionConfig limits on accepted connections, zero means unlimited
+type AdmissionConfig struct {
+	MaxConns      int
+	MaxConnsPerIP int
+
+	// AcceptRate accepts per second, AcceptBurst defaults to AcceptRate
+	AcceptRate  int
+	AcceptBurst int
+
+	// Allow Deny CIDR or single ip
+	// when Allow is not empty only matching ips are admitted
+	Allow []string
+	Deny  []string
+}
+
+// AdmissionStats rejected connections by reason
+type AdmissionStats struct {
+	Active      int64
+	Denied      uint64
+	RateLimited uint64
+	TooMany     uint64
+	TooManyIP   uint64
+}
+
+func (s AdmissionStats) Rejected() uint64 {
+	return s.Denied + s.RateLimited + s.TooMany + s.TooManyIP
+}
+
+// Admission decide whether an accepted connection may be served
+type Admission struct {
+	conf  AdmissionConfig
+	allow []*net.IPNet
+	deny  []*net.IPNet
+
+	mu     sync.Mutex
+	active int
+	perIP  map[string]int
+	bucket *tokenBucket
+
+	denied      uint64
+	rateLimited uint64
+	tooMany     uint64
+	tooManyIP   uint64
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip:%v", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// IsLoopback whether listening on address only accepts local peers
+// an empty host listens on every interface
+func IsLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Admit check addr against the rules and count it as active when admitted
+// every admitted addr must be Released
+// local unix socket peers are always admitted
+func (a *Admission) Admit(addr net.Addr) error {
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return nil
+	}
+	ip, err := a.check(addr)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.reserve(); err != nil {
+		return err
+	}
+	return a.admitIP(ip)
+}
+
+// Allowed the allow and deny checks of Admit alone, nothing is counted as active
+func (a *Admission) Allowed(addr net.Addr) error {
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return nil
+	}
+	_, err := a.check(addr)
+	return err
+}
+
+// Reserve the accept rate and connection count checks of Admit on the socket peer addr
+// for a connection whose client address is only known later, e.g. from a PROXY header
+// the reserved connection is then checked by AdmitReserved or freed by Unreserve
+func (a *Admission) Reserve(addr net.Addr) error {
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reserve()
+}
+
+// AdmitReserved the allow deny and per ip checks of Admit on the client address src
+// of a connection Reserved by its socket peer addr
+// once admitted src must be Released, otherwise the reservation is freed
+func (a *Admission) AdmitReserved(addr, src net.Addr) error {
+	if _, ok := addr.(*net.UnixAddr); ok {
+		// nothing reserved
+		return a.Admit(src)
+	}
+	ip, err := a.check(src)
+	if err != nil {
+		a.Unreserve(addr)
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.admitIP(ip)
+}
+
+// Unreserve free a reservation not admitted
+func (a *Admission) Unreserve(addr net.Addr) {
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return
+	}
+	a.mu.Lock()
+	a.active--
+	a.mu.Unlock()
+}
+
+// check the allow and deny lists
+func (a *Admission) check(addr net.Addr) (net.IP, error) {
+	ip := remoteIP(addr)
+	if ip == nil {
+		atomic.AddUint64(&a.denied, 1)
+		return nil, ErrInvalidRemote
+	}
+	if containsIP(a.deny, ip) || (len(a.allow) > 0 && !containsIP(a.allow, ip)) {
+		atomic.AddUint64(&a.denied, 1)
+		return nil, ErrDenied
+	}
+	return ip, nil
+}
+
+// reserve take a token and a connection slot, under mu
+func (a *Admission) reserve() error {
+	if !a.bucket.take(time.Now(), 1) {
+		atomic.AddUint64(&a.rateLimited, 1)
+		return ErrRateLimited
+	}
+	if a.conf.MaxConns > 0 && a.active >= a.conf.MaxConns {
+		atomic.AddUint64(&a.tooMany, 1)
+		return ErrTooManyConns
+	}
+	a.active++
+	return nil
+}
+
+// admitIP count ip on a reserved slot, freeing the slot when over its cap, under mu
+func (a *Admission) admitIP(ip net.IP) error {
+	key := ip.String()
+	if a.conf.MaxConnsPerIP > 0 && a.perIP[key] >= a.conf.MaxConnsPerIP {
+		a.active--
+		atomic.AddUint64(&a.tooManyIP, 1)
+		return ErrTooManyPerIP
+	}
+	a.perIP[key]++
+	return nil
+}
+
+// Release an admitted addr disconnected
+func (a *Admission) Release(addr net.Addr) {
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return
+	}
+	ip := remoteIP(addr)
+	if ip == nil {
+		return
+	}
+	key := ip.String()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.active--
+	if n := a.perIP[key] - 1; n > 0 {
+		a.perIP[key] = n
+	} else {
+		delete(a.perIP, key)
+	}
+}
+
+func (a *Admission) Stats() AdmissionStats {
+	a.mu.Lock()
+	active := a.active
+	a.mu.Unlock()
+	return AdmissionStats{
+		Active:      int64(active),
+		Denied:      atomic.LoadUint64(&a.denied),
+		RateLimited: atomic.LoadUint64(&a.rateLimited),
+		TooMany:     atomic.LoadUint64(&a.tooMany),
+		TooManyIP:   atomic.LoadUint64(&a.tooManyIP),
+	}
+}
+
+func NewAdmission(conf AdmissionConfig) (*Admission, error) {
+	allow, err := parseCIDRs(conf.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCIDRs(conf.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &Admission{
+		conf:   conf,
+		allow:  allow,
+		deny:   deny,
+		perIP:  make(map[string]int),
+		bucket: newTokenBucket(conf.AcceptRate, conf.AcceptBurst),
+	}, nil
+}
@@ -0,0 +1,102 @@
+package net
+
+import (
+	"net"
+	"testing"
+)
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1000}
+}
+
+func TestAdmission(t *testing.T) {
+	a, err := NewAdmission(AdmissionConfig{
+		MaxConns:      3,
+		MaxConnsPerIP: 2,
+		Allow:         []string{"10.0.0.0/8"},
+		Deny:          []string{"10.0.0.9"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		ip  string
+		err error
+	}{
+		{"10.0.0.1", nil},
+		{"10.0.0.1", nil},
+		{"10.0.0.1", ErrTooManyPerIP},
+		{"10.0.0.9", ErrDenied},
+		{"192.168.0.1", ErrDenied},
+		{"10.0.0.2", nil},
+		{"10.0.0.3", ErrTooManyConns},
+	}
+	for _, c := range cases {
+		if err := a.Admit(tcpAddr(c.ip)); err != c.err {
+			t.Errorf("admit %v err %v want %v", c.ip, err, c.err)
+		}
+	}
+
+	a.Release(tcpAddr("10.0.0.1"))
+	if err := a.Admit(tcpAddr("10.0.0.3")); err != nil {
+		t.Errorf("admit after release err %v", err)
+	}
+
+	s := a.Stats()
+	if s.Active != 3 || s.Denied != 2 || s.TooMany != 1 || s.TooManyIP != 1 {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+func TestAdmissionRate(t *testing.T) {
+	a, _ := NewAdmission(AdmissionConfig{AcceptRate: 1, AcceptBurst: 2})
+	for i, want := range []error{nil, nil, ErrRateLimited} {
+		if err := a.Admit(tcpAddr("10.0.0.1")); err != want {
+			t.Errorf("admit %v err %v want %v", i, err, want)
+		}
+	}
+}
+
+func TestAdmissionReserve(t *testing.T) {
+	a, _ := NewAdmission(AdmissionConfig{
+		MaxConns:      2,
+		MaxConnsPerIP: 1,
+		Deny:          []string{"10.0.0.9"},
+	})
+	proxy := tcpAddr("127.0.0.1")
+	if err := a.Reserve(proxy); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reserve(proxy); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reserve(proxy); err != ErrTooManyConns {
+		t.Errorf("reserve over max err %v", err)
+	}
+
+	if err := a.AdmitReserved(proxy, tcpAddr("10.0.0.9")); err != ErrDenied {
+		t.Errorf("denied source err %v", err)
+	}
+	if err := a.AdmitReserved(proxy, tcpAddr("10.0.0.1")); err != nil {
+		t.Errorf("admit source err %v", err)
+	}
+	if err := a.Reserve(proxy); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AdmitReserved(proxy, tcpAddr("10.0.0.1")); err != ErrTooManyPerIP {
+		t.Errorf("source over per ip err %v", err)
+	}
+	if s := a.Stats(); s.Active != 1 {
+		t.Errorf("active %v want 1", s.Active)
+	}
+
+	a.Release(tcpAddr("10.0.0.1"))
+	if err := a.Reserve(proxy); err != nil {
+		t.Fatal(err)
+	}
+	a.Unreserve(proxy)
+	if s := a.Stats(); s.Active != 0 {
+		t.Errorf("active %v want 0", s.Active)
+	}
+}
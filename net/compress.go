@@ -0,0 +1,355 @@
+package net
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	buf "github.com/zerak/ego/buffer"
+	"github.com/zerak/ego/proto"
+)
+
+// frame flags byte following the length header once compression is negotiated
+const flagCompressed = 0x01
+
+var (
+	ErrFrameFlags      = errors.New("invalid frame flags")
+	ErrDecompressLimit = errors.New("decompressed frame too large")
+)
+
+// Compressor a compression algorithm usable on frames
+type Compressor interface {
+	Name() string
+	Compress(src []byte) ([]byte, error)
+	// Decompress fail when the result exceeds limit bytes
+	Decompress(src []byte, limit int) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{}
+)
+
+// RegisterCompressor make c available to negotiation
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[c.Name()] = c
+}
+
+// GetCompressor get a registered compressor by name
+func GetCompressor(name string) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok := compressors[name]
+	return c, ok
+}
+
+func init() {
+	RegisterCompressor(deflateCompressor{})
+	RegisterCompressor(snappyCompressor{})
+	RegisterCompressor(newZstdCompressor())
+}
+
+type deflateCompressor struct{}
+
+func (deflateCompressor) Name() string { return "deflate" }
+func (deflateCompressor) Compress(src []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(src); err == nil {
+		err = w.Close()
+	}
+	return b.Bytes(), err
+}
+func (deflateCompressor) Decompress(src []byte, limit int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	b, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > limit {
+		return nil, ErrDecompressLimit
+	}
+	return b, nil
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string { return "snappy" }
+func (snappyCompressor) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+func (snappyCompressor) Decompress(src []byte, limit int) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n > limit {
+		return nil, ErrDecompressLimit
+	}
+	return snappy.Decode(nil, src)
+}
+
+// zstdCompressor decoders are capped at the limit they decode for,
+// a frame may not make them allocate more than that
+type zstdCompressor struct {
+	enc *zstd.Encoder
+
+	mu  sync.Mutex
+	dec map[int]*zstd.Decoder
+}
+
+func newZstdCompressor() *zstdCompressor {
+	enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	return &zstdCompressor{enc: enc, dec: make(map[int]*zstd.Decoder)}
+}
+
+// decoder the decoder of limit, sessions share a few limits at most
+func (z *zstdCompressor) decoder(limit int) (*zstd.Decoder, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if dec, ok := z.dec[limit]; ok {
+		return dec, nil
+	}
+	dec, err := zstd.NewReader(nil,
+		zstd.WithDecoderConcurrency(0),
+		zstd.WithDecoderMaxMemory(uint64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	z.dec[limit] = dec
+	return dec, nil
+}
+
+func (z *zstdCompressor) Name() string { return "zstd" }
+func (z *zstdCompressor) Compress(src []byte) ([]byte, error) {
+	return z.enc.EncodeAll(src, nil), nil
+}
+func (z *zstdCompressor) Decompress(src []byte, limit int) ([]byte, error) {
+	if limit <= 0 {
+		return nil, ErrDecompressLimit
+	}
+	var h zstd.Header
+	if err := h.Decode(src); err != nil {
+		return nil, err
+	}
+	if h.HasFCS && h.FrameContentSize > uint64(limit) {
+		return nil, ErrDecompressLimit
+	}
+	dec, err := z.decoder(limit)
+	if err != nil {
+		return nil, err
+	}
+	b, err := dec.DecodeAll(src, nil)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return nil, ErrDecompressLimit
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > limit {
+		return nil, ErrDecompressLimit
+	}
+	return b, nil
+}
+
+// Compression frame compression of one session
+// once enabled every frame carries a flags byte after the length header
+// and bodies of at least Threshold bytes are compressed
+type Compression struct {
+	Compressor       Compressor
+	Threshold        int
+	ByteNumForLength int
+}
+
+func NewCompression(c Compressor, threshold int) *Compression {
+	return &Compression{
+		Compressor:       c,
+		Threshold:        threshold,
+		ByteNumForLength: proto.DefaultByteNumForLength,
+	}
+}
+
+func (c *Compression) maxFrame() int {
+	return 1<<(uint(c.ByteNumForLength)<<3) - 1
+}
+
+// Encode turn a plain frame into a wire frame
+func (c *Compression) Encode(frame []byte) ([]byte, error) {
+	n := c.ByteNumForLength
+	if len(frame) < n {
+		return nil, proto.ErrTooShort
+	}
+	body := frame[n:]
+	flags := byte(0)
+	if len(body) >= c.Threshold {
+		if z, err := c.Compressor.Compress(body); err == nil && len(z) < len(body) {
+			body = z
+			flags |= flagCompressed
+		}
+	}
+	total := n + 1 + len(body)
+	if total > c.maxFrame() {
+		return nil, ErrFrameTooLarge
+	}
+	out := make([]byte, total)
+	proto.EncodeLength(total, out[:n])
+	out[n] = flags
+	copy(out[n+1:], body)
+	return out, nil
+}
+
+// Decode turn a wire frame back into the plain frame
+func (c *Compression) Decode(frame []byte) ([]byte, error) {
+	n := c.ByteNumForLength
+	if len(frame) < n+1 {
+		return nil, proto.ErrTooShort
+	}
+	flags := frame[n]
+	body := frame[n+1:]
+	switch flags {
+	case 0:
+	case flagCompressed:
+		b, err := c.Compressor.Decompress(body, c.maxFrame()-n)
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	default:
+		return nil, ErrFrameFlags
+	}
+	out := make([]byte, n+len(body))
+	proto.EncodeLength(len(out), out[:n])
+	copy(out[n:], body)
+	return out, nil
+}
+
+// CompressionPolicy the algorithms a server accepts
+type CompressionPolicy struct {
+	// Allowed algorithm names, empty allows every registered one
+	Allowed   []string
+	Threshold int
+}
+
+func (p CompressionPolicy) allowed(name string) bool {
+	if len(p.Allowed) == 0 {
+		return true
+	}
+	for _, a := range p.Allowed {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate pick the first algorithm in the client offer this side supports
+// offer is a comma separated list like "zstd,snappy" sent during handshake
+// nil means no compression
+func (p CompressionPolicy) Negotiate(offer string) *Compression {
+	for _, name := range strings.Split(offer, ",") {
+		name = strings.TrimSpace(name)
+		if !p.allowed(name) {
+			continue
+		}
+		if c, ok := GetCompressor(name); ok {
+			return NewCompression(c, p.Threshold)
+		}
+	}
+	return nil
+}
+
+// CompressionOffer the offer a client sends, prefer first then
+// every other registered algorithm by name
+func CompressionOffer(prefer ...string) string {
+	seen := map[string]bool{}
+	for _, name := range prefer {
+		seen[name] = true
+	}
+	var others []string
+	compressorsMu.RLock()
+	for name := range compressors {
+		if !seen[name] {
+			others = append(others, name)
+		}
+	}
+	compressorsMu.RUnlock()
+	sort.Strings(others)
+	return strings.Join(append(append([]string(nil), prefer...), others...), ",")
+}
+
+// CompressionFrame the name of the frame negotiating compression
+// the client sends it with its CompressionOffer as body and waits for the reply
+// whose body is the algorithm picked, empty for none
+// every frame after the reply is compressed both ways
+const CompressionFrame = "ego.compress"
+
+// NewCompressionFrame a CompressionFrame carrying body
+func NewCompressionFrame(body string) []byte {
+	n := proto.DefaultByteNumForLength
+	frame := make([]byte, n+n+len(CompressionFrame)+len(body))
+	proto.EncodeLength(len(frame), frame[:n])
+	proto.EncodeLength(len(CompressionFrame), frame[n:n+n])
+	copy(frame[n+n:], CompressionFrame)
+	copy(frame[n+n+len(CompressionFrame):], body)
+	return frame
+}
+
+// ParseCompressionFrame the body of a CompressionFrame, false for other frames
+func ParseCompressionFrame(frame []byte) (string, bool) {
+	name, err := proto.DecodeName(frame)
+	if err != nil || name != CompressionFrame {
+		return "", false
+	}
+	return string(frame[2*proto.DefaultByteNumForLength+len(name):]), true
+}
+
+// NegotiateCompression an inbound middleware answering the first CompressionFrame
+// of a session with the algorithm policy picks, then compressing the session
+// the session must have SetCompression like RWSession, otherwise none is picked
+func NegotiateCompression(policy CompressionPolicy) Middleware {
+	return func(next FrameFunc) FrameFunc {
+		done := false
+		return func(s Session, frame []byte) error {
+			offer, ok := ParseCompressionFrame(frame)
+			if !ok || done {
+				return next(s, frame)
+			}
+			done = true
+			var c *Compression
+			cs, ok := s.(interface{ SetCompression(*Compression) })
+			if ok {
+				c = policy.Negotiate(offer)
+			}
+			name := ""
+			if c != nil {
+				name = c.Compressor.Name()
+			}
+			b := buf.NewBuffer()
+			b.Add(1)
+			b.Write(NewCompressionFrame(name))
+			s.Send(b)
+			if c != nil {
+				cs.SetCompression(c)
+			}
+			return nil
+		}
+	}
+}
+
+func (c *Compression) String() string {
+	return fmt.Sprintf("%v>=%v", c.Compressor.Name(), c.Threshold)
+}
@@ -0,0 +1,203 @@
+package net
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	buf "github.com/zerak/ego/buffer"
+	"github.com/zerak/ego/proto"
+)
+
+func testFrame(body []byte) []byte {
+	frame := make([]byte, proto.DefaultByteNumForLength+len(body))
+	proto.EncodeLength(len(frame), frame[:proto.DefaultByteNumForLength])
+	copy(frame[proto.DefaultByteNumForLength:], body)
+	return frame
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	frame := testFrame(bytes.Repeat([]byte("ego frame "), 100))
+	for _, name := range []string{"deflate", "snappy", "zstd"} {
+		c, ok := GetCompressor(name)
+		if !ok {
+			t.Fatalf("compressor %v not registered", name)
+		}
+		comp := NewCompression(c, 64)
+		wire, err := comp.Encode(frame)
+		if err != nil {
+			t.Fatalf("%v encode err:%v", name, err)
+		}
+		if wire[proto.DefaultByteNumForLength] != flagCompressed || len(wire) >= len(frame) {
+			t.Errorf("%v frame not compressed, %v >= %v", name, len(wire), len(frame))
+		}
+		plain, err := comp.Decode(wire)
+		if err != nil {
+			t.Fatalf("%v decode err:%v", name, err)
+		}
+		if !bytes.Equal(plain, frame) {
+			t.Errorf("%v round trip mismatch", name)
+		}
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	c, _ := GetCompressor("snappy")
+	comp := NewCompression(c, 64)
+	frame := testFrame([]byte("short"))
+	wire, err := comp.Encode(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wire[proto.DefaultByteNumForLength] != 0 || len(wire) != len(frame)+1 {
+		t.Errorf("small frame should be sent plain")
+	}
+	if plain, err := comp.Decode(wire); err != nil || !bytes.Equal(plain, frame) {
+		t.Errorf("decode plain frame err:%v", err)
+	}
+	wire[proto.DefaultByteNumForLength] = 0x80
+	if _, err := comp.Decode(wire); err != ErrFrameFlags {
+		t.Errorf("err %v want %v", err, ErrFrameFlags)
+	}
+}
+
+func TestCompressionNegotiate(t *testing.T) {
+	p := CompressionPolicy{Allowed: []string{"snappy", "deflate"}}
+	if c := p.Negotiate("zstd, deflate,snappy"); c == nil || c.Compressor.Name() != "deflate" {
+		t.Errorf("negotiated %v want deflate", c)
+	}
+	if c := p.Negotiate("zstd,lz4"); c != nil {
+		t.Errorf("negotiated %v want none", c)
+	}
+	if offer := CompressionOffer("zstd"); offer != "zstd,deflate,snappy" {
+		t.Errorf("offer %v", offer)
+	}
+}
+
+func TestCompressionLimit(t *testing.T) {
+	body := bytes.Repeat([]byte{0}, 1<<20)
+	for _, name := range []string{"deflate", "snappy", "zstd"} {
+		c, _ := GetCompressor(name)
+		z, err := c.Compress(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Decompress(z, 1<<16); err != ErrDecompressLimit {
+			t.Errorf("%v decompress err %v want %v", name, err, ErrDecompressLimit)
+		}
+		if b, err := c.Decompress(z, len(body)); err != nil || len(b) != len(body) {
+			t.Errorf("%v decompress at the limit err %v", name, err)
+		}
+	}
+
+	// a frame not telling its size is stopped while decoding
+	var buf bytes.Buffer
+	w, _ := zstd.NewWriter(&buf, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	w.Write(body)
+	w.Close()
+	var h zstd.Header
+	if err := h.Decode(buf.Bytes()); err != nil || h.HasFCS {
+		t.Fatalf("streamed frame header %+v err %v", h, err)
+	}
+	c, _ := GetCompressor("zstd")
+	if _, err := c.Decompress(buf.Bytes(), 1<<16); err != ErrDecompressLimit {
+		t.Errorf("streamed frame err %v want %v", err, ErrDecompressLimit)
+	}
+}
+
+// readFrame read one length prefixed frame
+func readFrame(t *testing.T, r io.Reader) []byte {
+	n := proto.DefaultByteNumForLength
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		t.Fatal(err)
+	}
+	frame = append(frame, make([]byte, proto.DecodeLength(frame)-n)...)
+	if _, err := io.ReadFull(r, frame[n:]); err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+// handshake send the offer and get the algorithm the server picked
+func handshake(t *testing.T, conn net.Conn, offer string) string {
+	if _, err := conn.Write(NewCompressionFrame(offer)); err != nil {
+		t.Fatal(err)
+	}
+	name, ok := ParseCompressionFrame(readFrame(t, conn))
+	if !ok {
+		t.Fatal("no compression reply")
+	}
+	return name
+}
+
+func TestCompressionHandshake(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	packets := make(chanPacketHandler, 1)
+	rs := NewReadStream(server, packets)
+	s := NewRWSession(server, rs, "id", 4)
+	s.UseInbound(NegotiateCompression(CompressionPolicy{Allowed: []string{"snappy"}}))
+	go s.Run(nil, nil)
+
+	name := handshake(t, client, "zstd,snappy")
+	if name != "snappy" {
+		t.Fatalf("negotiated %q want snappy", name)
+	}
+	c, _ := GetCompressor(name)
+	comp := NewCompression(c, 0)
+
+	frame := testFrame(bytes.Repeat([]byte("ego frame "), 100))
+	wire, _ := comp.Encode(frame)
+	if _, err := client.Write(wire); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-packets:
+		if !bytes.Equal(b, frame) {
+			t.Error("server got a different frame")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("compressed frame not delivered")
+	}
+
+	b := buf.NewBuffer()
+	b.Add(1)
+	b.Write(frame)
+	s.Send(b)
+	wire = readFrame(t, client)
+	if wire[proto.DefaultByteNumForLength] != flagCompressed {
+		t.Error("server frame not compressed")
+	}
+	if plain, err := comp.Decode(wire); err != nil || !bytes.Equal(plain, frame) {
+		t.Errorf("server frame decode err:%v", err)
+	}
+}
+
+func TestTcpConnectorCompression(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := NewTcpConnector()
+	c.SetCompression(CompressionPolicy{Allowed: []string{"deflate"}})
+	go c.OnConnect(server)
+
+	if name := handshake(t, client, CompressionOffer("zstd")); name != "deflate" {
+		t.Errorf("negotiated %q want deflate", name)
+	}
+	// a second offer is a plain frame
+	comp, _ := GetCompressor("deflate")
+	wire, _ := NewCompression(comp, 0).Encode(NewCompressionFrame("snappy"))
+	if _, err := client.Write(wire); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("second offer answered, err %v", err)
+	}
+}
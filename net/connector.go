@@ -2,6 +2,8 @@ package net
 
 import (
 	"net"
+	"strconv"
+	"sync/atomic"
 
 	"github.com/zerak/ego/log"
 )
@@ -11,19 +13,61 @@ type Connector interface {
 	OnConnect(net.Conn)
 }
 
+// sessionSeq last session id given by a TcpConnector
+var sessionSeq uint64
+
 type TcpConnector struct {
-	conn net.Conn
+	limit       RateLimit
+	compression CompressionPolicy
+
+	dispatcher func() Dispatcher
+	key        KeyFunc
+	handler    func(Session) PacketHandler
+}
+
+// SetHandler choose the PacketHandler of every new session, default DefaultPacketHandler
+// the rate limit, compression and dispatcher still apply in front of it
+func (t *TcpConnector) SetHandler(handler func(Session) PacketHandler) { t.handler = handler }
+
+// SetDispatcher choose the Dispatcher of every new session
+// return a shared WorkerPool or LogicLoop, or a new SessionQueue per session
+func (t *TcpConnector) SetDispatcher(dispatcher func() Dispatcher, key KeyFunc) {
+	t.dispatcher = dispatcher
+	t.key = key
 }
 
-func (t *TcpConnector) OnDisconnect() {
-	log.Info("%v disconnect", t.conn.RemoteAddr().String())
+// SetRateLimit limit inbound frames of every session
+func (t *TcpConnector) SetRateLimit(limit RateLimit) { t.limit = limit }
+
+// SetCompression the algorithms sessions may negotiate at handshake
+// see CompressionFrame
+func (t *TcpConnector) SetCompression(policy CompressionPolicy) { t.compression = policy }
+
+// Compression the algorithms sessions may negotiate
+func (t *TcpConnector) Compression() CompressionPolicy { return t.compression }
+
+func (t *TcpConnector) OnDisconnect(conn net.Conn) {
+	log.Info("%v disconnect", conn.RemoteAddr().String())
 }
 
 func (t *TcpConnector) OnConnect(conn net.Conn) {
-	t.conn = conn
-	rs := NewReadStream(conn, NewDefaultPacketHandler())
-	rw := NewRWSession(conn, rs, "server id", 100)
-	rw.Run(nil, t.OnDisconnect)
+	rs := NewStreamReader(conn, NewDefaultPacketHandler())
+	id := strconv.FormatUint(atomic.AddUint64(&sessionSeq, 1), 10)
+	rw := NewRWSession(conn, rs, id, 100)
+	if t.handler != nil {
+		rw.SetHandler(t.handler(rw))
+	}
+	if t.dispatcher != nil {
+		rw.SetDispatcher(t.dispatcher(), t.key)
+	}
+	if t.limit.Enabled() {
+		// on the read goroutine, before frames are dispatched
+		guard := NewFloodGuard(nil, t.limit)
+		guard.Bind(rw)
+		rw.UseInbound(guard.Middleware())
+	}
+	rw.UseInbound(NegotiateCompression(t.compression))
+	rw.Run(nil, func() { t.OnDisconnect(conn) })
 }
 
 func NewTcpConnector() *TcpConnector {
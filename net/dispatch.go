@@ -0,0 +1,194 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+var ErrDispatcherClosed = errors.New("dispatcher closed")
+
+// Dispatcher run frame handling off the read goroutine
+// fns dispatched with the same key run in order
+type Dispatcher interface {
+	Dispatch(key uint64, fn func()) error
+}
+
+// KeyFunc ordering key of a frame, e.g. the table id it is addressed to
+// frames of different keys may be handled concurrently
+type KeyFunc func(s Session, frame []byte) uint64
+
+// SessionKey order frames per session, the default KeyFunc
+func SessionKey(s Session, _ []byte) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s.Id()))
+	return h.Sum64()
+}
+
+type DispatchMode int
+
+const (
+	// DispatchInline handle frames in the read goroutine
+	DispatchInline DispatchMode = iota
+	// DispatchSession one ordered queue and goroutine per session
+	DispatchSession
+	// DispatchPool shared workers, frames of the same key are ordered
+	DispatchPool
+	// DispatchLoop one logic goroutine for every session
+	DispatchLoop
+)
+
+func (m DispatchMode) String() string {
+	switch m {
+	case DispatchInline:
+		return "inline"
+	case DispatchSession:
+		return "session"
+	case DispatchPool:
+		return "pool"
+	case DispatchLoop:
+		return "loop"
+	}
+	return fmt.Sprintf("DispatchMode(%d)", int(m))
+}
+
+// ParseDispatchMode parse inline/session/pool/loop, empty means inline
+func ParseDispatchMode(s string) (DispatchMode, error) {
+	switch s {
+	case "", "inline":
+		return DispatchInline, nil
+	case "session":
+		return DispatchSession, nil
+	case "pool":
+		return DispatchPool, nil
+	case "loop":
+		return DispatchLoop, nil
+	}
+	return DispatchInline, fmt.Errorf("invalid dispatch mode:%v", s)
+}
+
+// WorkerPool fixed workers each with its own queue
+// a key always goes to the same worker
+type WorkerPool struct {
+	mu     sync.RWMutex
+	closed bool
+	queues []chan func()
+	wg     sync.WaitGroup
+}
+
+func (p *WorkerPool) work(q chan func()) {
+	defer p.wg.Done()
+	for fn := range q {
+		fn()
+	}
+}
+
+// Dispatch queue fn on the worker of key, blocks while that queue is full
+func (p *WorkerPool) Dispatch(key uint64, fn func()) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrDispatcherClosed
+	}
+	p.queues[key%uint64(len(p.queues))] <- fn
+	return nil
+}
+
+// Post run fn on the worker of key, for timers and other non frame work
+func (p *WorkerPool) Post(key uint64, fn func()) error { return p.Dispatch(key, fn) }
+
+// Close stop accepting, run what is queued then stop the workers
+func (p *WorkerPool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+func NewWorkerPool(workers, queueSize int) *WorkerPool {
+	if workers <= 0 {
+		workers = 1
+	}
+	if queueSize <= 0 {
+		queueSize = 1024
+	}
+	p := &WorkerPool{queues: make([]chan func(), workers)}
+	for i := range p.queues {
+		p.queues[i] = make(chan func(), queueSize)
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+// SessionQueue an ordered queue owned by one session
+// it is closed by the session when it ends
+type SessionQueue struct {
+	*WorkerPool
+}
+
+func NewSessionQueue(queueSize int) *SessionQueue {
+	return &SessionQueue{NewWorkerPool(1, queueSize)}
+}
+
+// NewLogicLoop a single goroutine shared by every session
+// game logic running on it needs no locking
+func NewLogicLoop(queueSize int) *WorkerPool {
+	return NewWorkerPool(1, queueSize)
+}
+
+// dispatchHandler hand frames to a Dispatcher
+// owned frames are retained, plain ones copied since the read buffer is reused
+type dispatchHandler struct {
+	session *RWSession
+	d       Dispatcher
+	key     KeyFunc
+	handler PacketHandler
+	pending sync.WaitGroup
+}
+
+func (h *dispatchHandler) OnPacket(b []byte) {
+	frame := append([]byte(nil), b...)
+	h.pending.Add(1)
+	err := h.d.Dispatch(h.key(h.session, frame), func() {
+		defer h.pending.Done()
+		defer func() {
+			if v := recover(); v != nil {
+				h.session.recovered(frameName(frame), v)
+			}
+		}()
+		h.handler.OnPacket(frame)
+	})
+	if err != nil {
+		h.pending.Done()
+		h.session.closeWith(err)
+	}
+}
+
+func (h *dispatchHandler) OnFrame(f *Frame) {
+	f.Retain()
+	h.pending.Add(1)
+	err := h.d.Dispatch(h.key(h.session, f.Bytes()), func() {
+		defer h.pending.Done()
+		defer f.Release()
+		defer func() {
+			if v := recover(); v != nil {
+				h.session.recovered(frameName(f.Bytes()), v)
+			}
+		}()
+		deliver(h.handler, f)
+	})
+	if err != nil {
+		f.Release()
+		h.pending.Done()
+		h.session.closeWith(err)
+	}
+}
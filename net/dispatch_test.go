@@ -0,0 +1,125 @@
+package net
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolOrder(t *testing.T) {
+	p := NewWorkerPool(4, 16)
+	var mu sync.Mutex
+	got := map[uint64][]int{}
+	for i := 0; i < 100; i++ {
+		key, i := uint64(i%3), i
+		p.Dispatch(key, func() {
+			mu.Lock()
+			got[key] = append(got[key], i)
+			mu.Unlock()
+		})
+	}
+	p.Close()
+	for key, list := range got {
+		for j := 1; j < len(list); j++ {
+			if list[j] <= list[j-1] {
+				t.Fatalf("key %v out of order %v", key, list)
+			}
+		}
+	}
+	if err := p.Dispatch(0, func() {}); err != ErrDispatcherClosed {
+		t.Errorf("err %v want %v", err, ErrDispatcherClosed)
+	}
+}
+
+func TestSessionDispatch(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	var frames [][]byte
+	reader := make(chan struct{})
+	rs := NewReadStream(server, packetHandlerFunc(func(b []byte) {
+		time.Sleep(10 * time.Millisecond)
+		frames = append(frames, b)
+	}))
+	s := NewRWSession(server, rs, "id", 1)
+	s.SetDispatcher(NewSessionQueue(8), nil)
+	s.UseInbound(func(next FrameFunc) FrameFunc {
+		return func(s Session, frame []byte) error {
+			reader <- struct{}{}
+			return next(s, frame)
+		}
+	})
+	done := make(chan struct{})
+	var handled int
+	go func() {
+		s.Run(nil, func() { handled = len(frames) })
+		close(done)
+	}()
+
+	for i := 0; i < 3; i++ {
+		client.Write([]byte{3, 0, byte(i)})
+		<-reader
+	}
+	client.Close()
+	<-done
+	if handled != 3 {
+		t.Fatalf("handled %v frames before quit want 3", handled)
+	}
+	for i, f := range frames {
+		if f[2] != byte(i) {
+			t.Errorf("frame %v = %v", i, f)
+		}
+	}
+}
+
+type keyDispatcher chan uint64
+
+func (d keyDispatcher) Dispatch(key uint64, fn func()) error {
+	d <- key
+	fn()
+	return nil
+}
+
+func TestTcpConnectorSessionKeys(t *testing.T) {
+	keys := make(keyDispatcher, 2)
+	c := NewTcpConnector()
+	c.SetDispatcher(func() Dispatcher { return keys }, nil)
+	for i := 0; i < 2; i++ {
+		server, client := net.Pipe()
+		defer client.Close()
+		go c.OnConnect(server)
+		client.Write([]byte{3, 0, byte(i)})
+	}
+	// sessions of one connector are spread over the pool
+	if a, b := <-keys, <-keys; a == b {
+		t.Errorf("two sessions share key %v", a)
+	}
+}
+
+func TestTcpConnectorHandler(t *testing.T) {
+	packets := make(chanPacketHandler, 1)
+	c := NewTcpConnector()
+	c.SetRateLimit(RateLimit{FramesPerSecond: 10})
+	sessions := make(chan Session, 1)
+	c.SetHandler(func(s Session) PacketHandler {
+		sessions <- s
+		return packets
+	})
+	server, client := net.Pipe()
+	defer client.Close()
+	go c.OnConnect(server)
+
+	if s := <-sessions; s.Id() == "" {
+		t.Error("session without id")
+	}
+	client.Write([]byte{3, 0, 1})
+	select {
+	case b := <-packets:
+		if b[2] != 1 {
+			t.Errorf("frame %v", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("frame not handled")
+	}
+}
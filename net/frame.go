@@ -0,0 +1,132 @@
+package net
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	buf "github.com/zerak/ego/buffer"
+	"github.com/zerak/ego/log"
+)
+
+var ErrFrameReleased = errors.New("frame used after release")
+
+const framePoison = 0xdd
+
+var (
+	frameDebug int32
+
+	framePoolOnce sync.Once
+	framePool     *buf.Pool
+)
+
+// SetFrameDebug check every Frame access against its references
+// released frames are poisoned and any later use panics
+func SetFrameDebug(on bool) {
+	v := int32(0)
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&frameDebug, v)
+}
+
+func isFrameDebug() bool { return atomic.LoadInt32(&frameDebug) == 1 }
+
+// DefaultFramePool the pool read buffers come from unless a stream sets its own
+func DefaultFramePool() *buf.Pool {
+	framePoolOnce.Do(func() {
+		framePool = buf.NewPool(0, 1024)
+	})
+	return framePool
+}
+
+// Frame an inbound frame owned by whoever holds a reference
+// the stream holds one while the handler runs and releases it afterwards
+// a handler keeping the frame longer must Retain it and Release when done
+type Frame struct {
+	b    *buf.Buffer
+	data []byte
+	refs int32
+}
+
+// FrameHandler a PacketHandler that takes owned frames
+// streams call OnFrame instead of OnPacket when the handler implements it
+type FrameHandler interface {
+	OnFrame(f *Frame)
+}
+
+func (f *Frame) check() {
+	if isFrameDebug() && atomic.LoadInt32(&f.refs) <= 0 {
+		panic(ErrFrameReleased)
+	}
+}
+
+// Bytes the whole frame, length header included
+// only valid while a reference is held
+func (f *Frame) Bytes() []byte {
+	f.check()
+	if f.b != nil {
+		return f.b.Bytes()
+	}
+	return f.data
+}
+
+func (f *Frame) Len() int { return len(f.Bytes()) }
+
+// Retain take one more reference
+func (f *Frame) Retain() *Frame {
+	f.check()
+	atomic.AddInt32(&f.refs, 1)
+	return f
+}
+
+// Release drop one reference, the last one returns the buffer to its pool
+func (f *Frame) Release() {
+	n := atomic.AddInt32(&f.refs, -1)
+	if n > 0 {
+		return
+	}
+	if n < 0 {
+		if isFrameDebug() {
+			panic(ErrFrameReleased)
+		}
+		log.Error("frame released %v times too many", -n)
+		return
+	}
+	if f.b == nil {
+		return
+	}
+	if isFrameDebug() {
+		b := f.b.Bytes()
+		for i := range b {
+			b[i] = framePoison
+		}
+	}
+	f.b.Done()
+}
+
+// NewFrame an owned frame over b, nothing is pooled
+func NewFrame(b []byte) *Frame {
+	return &Frame{data: b, refs: 1}
+}
+
+func newPoolFrame(pool *buf.Pool, size int) *Frame {
+	b, _ := pool.GetSize(size)
+	return &Frame{b: b, refs: 1}
+}
+
+// deliver hand f to h, as an owned frame when h takes them
+func deliver(h PacketHandler, f *Frame) {
+	if fh, ok := h.(FrameHandler); ok {
+		fh.OnFrame(f)
+		return
+	}
+	h.OnPacket(f.Bytes())
+}
+
+func sameBytes(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	return len(a) == 0 || &a[0] == &b[0]
+}
@@ -0,0 +1,59 @@
+package net
+
+import (
+	"net"
+	"testing"
+)
+
+type frameHandlerFunc func(*Frame)
+
+func (f frameHandlerFunc) OnPacket(b []byte) { f(NewFrame(b)) }
+func (f frameHandlerFunc) OnFrame(fr *Frame) { f(fr) }
+
+func TestFrameRetain(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	var kept []*Frame
+	rs := NewReadStream(server, frameHandlerFunc(func(f *Frame) {
+		kept = append(kept, f.Retain())
+	}))
+	go client.Write([]byte{3, 0, 'a', 3, 0, 'b'})
+	for i := 0; i < 2; i++ {
+		if _, err := rs.Read(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(kept) != 2 || kept[0].Bytes()[2] != 'a' || kept[1].Bytes()[2] != 'b' {
+		t.Fatalf("retained frames overwritten")
+	}
+	for _, f := range kept {
+		f.Release()
+	}
+}
+
+func TestFrameDebug(t *testing.T) {
+	SetFrameDebug(true)
+	defer SetFrameDebug(false)
+
+	f := newPoolFrame(DefaultFramePool(), 3)
+	f.b.WriteString("abc")
+	data := f.Bytes()
+	f.Release()
+	if data[0] != framePoison {
+		t.Errorf("released frame not poisoned")
+	}
+
+	mustPanic := func(name string, fn func()) {
+		defer func() {
+			if v := recover(); v != ErrFrameReleased {
+				t.Errorf("%v recovered %v want %v", name, v, ErrFrameReleased)
+			}
+		}()
+		fn()
+	}
+	mustPanic("bytes", func() { f.Bytes() })
+	mustPanic("retain", func() { f.Retain() })
+	mustPanic("release", func() { f.Release() })
+}
@@ -0,0 +1,498 @@
+package net
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// kcp segment header, wire compatible with ikcp
+// conv(4) cmd(1) frg(1) wnd(2) ts(4) sn(4) una(4) len(4)
+const (
+	kcpCmdPush = 81
+	kcpCmdAck  = 82
+	kcpCmdWask = 83
+	kcpCmdWins = 84
+
+	kcpAskSend = 1
+	kcpAskTell = 2
+
+	kcpOverhead   = 24
+	kcpMtu        = 1400
+	kcpWndSnd     = 128
+	kcpWndRcv     = 128
+	kcpRtoMin     = 30
+	kcpRtoDef     = 200
+	kcpRtoMax     = 60000
+	kcpInterval   = 10
+	kcpFastResend = 2
+	kcpDeadLink   = 20
+	kcpProbeInit  = 7000
+	kcpProbeLimit = 120000
+)
+
+var (
+	ErrKcpShort    = errors.New("kcp segment too short")
+	ErrKcpConv     = errors.New("kcp conv mismatch")
+	ErrKcpCmd      = errors.New("kcp unknown cmd")
+	ErrKcpTooLarge = errors.New("kcp message too large")
+)
+
+type kcpSegment struct {
+	conv uint32
+	cmd  uint8
+	frg  uint8
+	wnd  uint16
+	ts   uint32
+	sn   uint32
+	una  uint32
+	data []byte
+
+	resendts uint32
+	rto      uint32
+	fastack  uint32
+	xmit     uint32
+}
+
+func (s *kcpSegment) encode(b []byte) []byte {
+	var h [kcpOverhead]byte
+	binary.LittleEndian.PutUint32(h[0:], s.conv)
+	h[4] = s.cmd
+	h[5] = s.frg
+	binary.LittleEndian.PutUint16(h[6:], s.wnd)
+	binary.LittleEndian.PutUint32(h[8:], s.ts)
+	binary.LittleEndian.PutUint32(h[12:], s.sn)
+	binary.LittleEndian.PutUint32(h[16:], s.una)
+	binary.LittleEndian.PutUint32(h[20:], uint32(len(s.data)))
+	b = append(b, h[:]...)
+	return append(b, s.data...)
+}
+
+func kcpDiff(later, earlier uint32) int32 { return int32(later - earlier) }
+
+// kcp the ARQ state machine of one conversation
+// it runs in nodelay mode without congestion window
+// and is not safe for concurrent use
+type kcp struct {
+	conv    uint32
+	mtu     uint32
+	mss     uint32
+	current uint32
+	dead    bool
+
+	sndUna uint32
+	sndNxt uint32
+	rcvNxt uint32
+
+	rxSrtt   int32
+	rxRttval int32
+	rxRto    int32
+
+	sndWnd uint32
+	rcvWnd uint32
+	rmtWnd uint32
+
+	probe     uint32
+	probeWait uint32
+	tsProbe   uint32
+
+	sndQueue []*kcpSegment
+	sndBuf   []*kcpSegment
+	rcvQueue []*kcpSegment
+	rcvBuf   []*kcpSegment
+	acklist  []uint32
+
+	buf    []byte
+	output func([]byte)
+}
+
+func newKcp(conv uint32, output func([]byte)) *kcp {
+	return &kcp{
+		conv:   conv,
+		mtu:    kcpMtu,
+		mss:    kcpMtu - kcpOverhead,
+		rxRto:  kcpRtoDef,
+		sndWnd: kcpWndSnd,
+		rcvWnd: kcpWndRcv,
+		rmtWnd: kcpWndRcv,
+		buf:    make([]byte, 0, kcpMtu),
+		output: output,
+	}
+}
+
+// peekSize size of the next complete message or -1
+func (k *kcp) peekSize() int {
+	if len(k.rcvQueue) == 0 {
+		return -1
+	}
+	seg := k.rcvQueue[0]
+	if seg.frg == 0 {
+		return len(seg.data)
+	}
+	if len(k.rcvQueue) < int(seg.frg)+1 {
+		return -1
+	}
+	n := 0
+	for _, s := range k.rcvQueue {
+		n += len(s.data)
+		if s.frg == 0 {
+			break
+		}
+	}
+	return n
+}
+
+// recv pop the next complete message, nil if none
+func (k *kcp) recv() []byte {
+	size := k.peekSize()
+	if size < 0 {
+		return nil
+	}
+	fastRecover := uint32(len(k.rcvQueue)) >= k.rcvWnd
+
+	b := make([]byte, 0, size)
+	count := 0
+	for _, s := range k.rcvQueue {
+		b = append(b, s.data...)
+		count++
+		if s.frg == 0 {
+			break
+		}
+	}
+	k.rcvQueue = k.rcvQueue[count:]
+	k.moveRcvBuf()
+
+	// tell the remote our window reopened
+	if fastRecover && uint32(len(k.rcvQueue)) < k.rcvWnd {
+		k.probe |= kcpAskTell
+	}
+	return b
+}
+
+// send split b into segments and queue them
+func (k *kcp) send(b []byte) error {
+	count := (len(b) + int(k.mss) - 1) / int(k.mss)
+	if count == 0 {
+		count = 1
+	}
+	if count >= 255 || uint32(count) >= k.rcvWnd {
+		return ErrKcpTooLarge
+	}
+	for i := 0; i < count; i++ {
+		size := len(b)
+		if size > int(k.mss) {
+			size = int(k.mss)
+		}
+		seg := &kcpSegment{
+			frg:  uint8(count - i - 1),
+			data: append([]byte(nil), b[:size]...),
+		}
+		k.sndQueue = append(k.sndQueue, seg)
+		b = b[size:]
+	}
+	return nil
+}
+
+// waitSnd number of segments not acked yet
+func (k *kcp) waitSnd() int { return len(k.sndBuf) + len(k.sndQueue) }
+
+func (k *kcp) updateAck(rtt int32) {
+	if k.rxSrtt == 0 {
+		k.rxSrtt = rtt
+		k.rxRttval = rtt / 2
+	} else {
+		delta := rtt - k.rxSrtt
+		if delta < 0 {
+			delta = -delta
+		}
+		k.rxRttval = (3*k.rxRttval + delta) / 4
+		k.rxSrtt = (7*k.rxSrtt + rtt) / 8
+		if k.rxSrtt < 1 {
+			k.rxSrtt = 1
+		}
+	}
+	rto := k.rxSrtt + 4*k.rxRttval
+	if rto < k.rxSrtt+kcpInterval {
+		rto = k.rxSrtt + kcpInterval
+	}
+	if rto < kcpRtoMin {
+		rto = kcpRtoMin
+	}
+	if rto > kcpRtoMax {
+		rto = kcpRtoMax
+	}
+	k.rxRto = rto
+}
+
+func (k *kcp) shrinkBuf() {
+	if len(k.sndBuf) > 0 {
+		k.sndUna = k.sndBuf[0].sn
+	} else {
+		k.sndUna = k.sndNxt
+	}
+}
+
+func (k *kcp) parseAck(sn uint32) {
+	if kcpDiff(sn, k.sndUna) < 0 || kcpDiff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for i, s := range k.sndBuf {
+		if s.sn == sn {
+			k.sndBuf = append(k.sndBuf[:i], k.sndBuf[i+1:]...)
+			break
+		}
+		if kcpDiff(sn, s.sn) < 0 {
+			break
+		}
+	}
+}
+
+func (k *kcp) parseUna(una uint32) {
+	count := 0
+	for _, s := range k.sndBuf {
+		if kcpDiff(una, s.sn) <= 0 {
+			break
+		}
+		count++
+	}
+	k.sndBuf = k.sndBuf[count:]
+}
+
+func (k *kcp) parseFastack(sn uint32) {
+	if kcpDiff(sn, k.sndUna) < 0 || kcpDiff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for _, s := range k.sndBuf {
+		if kcpDiff(sn, s.sn) < 0 {
+			break
+		}
+		if sn != s.sn {
+			s.fastack++
+		}
+	}
+}
+
+func (k *kcp) parseData(seg *kcpSegment) {
+	sn := seg.sn
+	if kcpDiff(sn, k.rcvNxt+k.rcvWnd) >= 0 || kcpDiff(sn, k.rcvNxt) < 0 {
+		return
+	}
+
+	// insert ordered by sn, drop duplicates
+	i := len(k.rcvBuf)
+	for ; i > 0; i-- {
+		s := k.rcvBuf[i-1]
+		if s.sn == sn {
+			return
+		}
+		if kcpDiff(sn, s.sn) > 0 {
+			break
+		}
+	}
+	k.rcvBuf = append(k.rcvBuf, nil)
+	copy(k.rcvBuf[i+1:], k.rcvBuf[i:])
+	k.rcvBuf[i] = seg
+
+	k.moveRcvBuf()
+}
+
+func (k *kcp) moveRcvBuf() {
+	count := 0
+	for _, s := range k.rcvBuf {
+		if s.sn != k.rcvNxt || uint32(len(k.rcvQueue)) >= k.rcvWnd {
+			break
+		}
+		k.rcvQueue = append(k.rcvQueue, s)
+		k.rcvNxt++
+		count++
+	}
+	k.rcvBuf = k.rcvBuf[count:]
+}
+
+// input feed one datagram received from the remote
+func (k *kcp) input(data []byte) error {
+	if len(data) < kcpOverhead {
+		return ErrKcpShort
+	}
+
+	var maxack uint32
+	flag := false
+	for len(data) >= kcpOverhead {
+		conv := binary.LittleEndian.Uint32(data[0:])
+		if conv != k.conv {
+			return ErrKcpConv
+		}
+		cmd := data[4]
+		frg := data[5]
+		wnd := binary.LittleEndian.Uint16(data[6:])
+		ts := binary.LittleEndian.Uint32(data[8:])
+		sn := binary.LittleEndian.Uint32(data[12:])
+		una := binary.LittleEndian.Uint32(data[16:])
+		length := binary.LittleEndian.Uint32(data[20:])
+		data = data[kcpOverhead:]
+		if uint32(len(data)) < length {
+			return ErrKcpShort
+		}
+		if cmd < kcpCmdPush || cmd > kcpCmdWins {
+			return ErrKcpCmd
+		}
+
+		k.rmtWnd = uint32(wnd)
+		k.parseUna(una)
+		k.shrinkBuf()
+
+		switch cmd {
+		case kcpCmdAck:
+			if rtt := kcpDiff(k.current, ts); rtt >= 0 {
+				k.updateAck(rtt)
+			}
+			k.parseAck(sn)
+			k.shrinkBuf()
+			if !flag || kcpDiff(sn, maxack) > 0 {
+				flag = true
+				maxack = sn
+			}
+		case kcpCmdPush:
+			if kcpDiff(sn, k.rcvNxt+k.rcvWnd) < 0 {
+				k.acklist = append(k.acklist, sn, ts)
+				if kcpDiff(sn, k.rcvNxt) >= 0 {
+					k.parseData(&kcpSegment{
+						conv: conv,
+						cmd:  cmd,
+						frg:  frg,
+						wnd:  wnd,
+						ts:   ts,
+						sn:   sn,
+						una:  una,
+						data: append([]byte(nil), data[:length]...),
+					})
+				}
+			}
+		case kcpCmdWask:
+			k.probe |= kcpAskTell
+		case kcpCmdWins:
+			// remote window already updated
+		}
+		data = data[length:]
+	}
+	if flag {
+		k.parseFastack(maxack)
+	}
+	return nil
+}
+
+func (k *kcp) wndUnused() uint16 {
+	if n := uint32(len(k.rcvQueue)); n < k.rcvWnd {
+		return uint16(k.rcvWnd - n)
+	}
+	return 0
+}
+
+// flush send pending acks, probes, new and timed out segments
+func (k *kcp) flush() {
+	seg := kcpSegment{
+		conv: k.conv,
+		cmd:  kcpCmdAck,
+		wnd:  k.wndUnused(),
+		una:  k.rcvNxt,
+	}
+	buf := k.buf[:0]
+	reserve := func(n int) {
+		if len(buf)+n > int(k.mtu) {
+			k.output(buf)
+			buf = k.buf[:0]
+		}
+	}
+
+	// acks
+	for i := 0; i+1 < len(k.acklist); i += 2 {
+		reserve(kcpOverhead)
+		seg.sn, seg.ts = k.acklist[i], k.acklist[i+1]
+		buf = seg.encode(buf)
+	}
+	k.acklist = k.acklist[:0]
+	seg.sn, seg.ts = 0, 0
+
+	// probe the remote window when it is closed
+	if k.rmtWnd == 0 {
+		if k.probeWait == 0 {
+			k.probeWait = kcpProbeInit
+			k.tsProbe = k.current + k.probeWait
+		} else if kcpDiff(k.current, k.tsProbe) >= 0 {
+			k.probeWait += k.probeWait / 2
+			if k.probeWait > kcpProbeLimit {
+				k.probeWait = kcpProbeLimit
+			}
+			k.tsProbe = k.current + k.probeWait
+			k.probe |= kcpAskSend
+		}
+	} else {
+		k.tsProbe = 0
+		k.probeWait = 0
+	}
+	if k.probe&kcpAskSend != 0 {
+		seg.cmd = kcpCmdWask
+		reserve(kcpOverhead)
+		buf = seg.encode(buf)
+	}
+	if k.probe&kcpAskTell != 0 {
+		seg.cmd = kcpCmdWins
+		reserve(kcpOverhead)
+		buf = seg.encode(buf)
+	}
+	k.probe = 0
+
+	// move queued segments into the send window
+	cwnd := k.sndWnd
+	if k.rmtWnd < cwnd {
+		cwnd = k.rmtWnd
+	}
+	for len(k.sndQueue) > 0 && kcpDiff(k.sndNxt, k.sndUna+cwnd) < 0 {
+		s := k.sndQueue[0]
+		k.sndQueue = k.sndQueue[1:]
+		s.conv = k.conv
+		s.cmd = kcpCmdPush
+		s.sn = k.sndNxt
+		k.sndNxt++
+		k.sndBuf = append(k.sndBuf, s)
+	}
+
+	for _, s := range k.sndBuf {
+		send := false
+		switch {
+		case s.xmit == 0:
+			send = true
+			s.rto = uint32(k.rxRto)
+			s.resendts = k.current + s.rto
+		case kcpDiff(k.current, s.resendts) >= 0:
+			send = true
+			s.rto += uint32(k.rxRto) / 2
+			s.resendts = k.current + s.rto
+		case s.fastack >= kcpFastResend:
+			send = true
+			s.fastack = 0
+			s.resendts = k.current + s.rto
+		}
+		if !send {
+			continue
+		}
+		s.xmit++
+		s.ts = k.current
+		s.wnd = seg.wnd
+		s.una = k.rcvNxt
+		reserve(kcpOverhead + len(s.data))
+		buf = s.encode(buf)
+		if s.xmit >= kcpDeadLink {
+			k.dead = true
+		}
+	}
+
+	if len(buf) > 0 {
+		k.output(buf)
+	}
+}
+
+// update set the clock in milliseconds and flush
+func (k *kcp) update(current uint32) {
+	k.current = current
+	k.flush()
+}
@@ -0,0 +1,457 @@
+package net
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zerak/ego/log"
+)
+
+// kcpSndQueueFactor Write blocks once this many send windows are not acked
+const kcpSndQueueFactor = 4
+
+// DefaultKcpMaxSessions conversations a KcpListener serves at most
+const DefaultKcpMaxSessions = 4096
+
+var (
+	ErrKcpClosed  = errors.New("kcp conn closed")
+	ErrKcpTimeout = &kcpTimeoutError{}
+
+	kcpEpoch = time.Now()
+)
+
+type kcpTimeoutError struct{}
+
+func (e *kcpTimeoutError) Error() string   { return "kcp i/o timeout" }
+func (e *kcpTimeoutError) Timeout() bool   { return true }
+func (e *kcpTimeoutError) Temporary() bool { return true }
+
+func kcpNow() uint32 { return uint32(time.Since(kcpEpoch) / time.Millisecond) }
+
+// KcpConn one reliable conversation over udp
+// it is a stream net.Conn so ReadStream and RWSession work unchanged
+type KcpConn struct {
+	mu       sync.Mutex
+	kcp      *kcp
+	conn     *net.UDPConn
+	remote   *net.UDPAddr
+	msg      []byte
+	lastRecv time.Time
+
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+	closed     chan struct{}
+	closeOnce  sync.Once
+	onClose    func(*KcpConn)
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// Conv the conversation id
+func (c *KcpConn) Conv() uint32 { return c.kcp.conv }
+
+func (c *KcpConn) Read(b []byte) (int, error) {
+	for {
+		if len(c.msg) > 0 {
+			n := copy(b, c.msg)
+			c.msg = c.msg[n:]
+			return n, nil
+		}
+
+		c.mu.Lock()
+		msg := c.kcp.recv()
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		if msg != nil {
+			c.msg = msg
+			continue
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, ErrKcpTimeout
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		select {
+		case <-c.readEvent:
+		case <-c.closed:
+			return 0, ErrKcpClosed
+		case <-timeout:
+			return 0, ErrKcpTimeout
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Write queue b, it blocks while kcpSndQueueFactor send windows are not acked
+// until the write deadline
+func (c *KcpConn) Write(b []byte) (int, error) {
+	for {
+		select {
+		case <-c.closed:
+			return 0, ErrKcpClosed
+		default:
+		}
+
+		c.mu.Lock()
+		deadline := c.writeDeadline
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			c.mu.Unlock()
+			return 0, ErrKcpTimeout
+		}
+		if c.kcp.waitSnd() < int(c.kcp.sndWnd)*kcpSndQueueFactor {
+			err := c.kcp.send(b)
+			if err == nil {
+				c.kcp.update(kcpNow())
+			}
+			c.mu.Unlock()
+			if err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		}
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		select {
+		case <-c.writeEvent:
+		case <-c.closed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (c *KcpConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.onClose != nil {
+			c.onClose(c)
+		}
+	})
+	return nil
+}
+
+func (c *KcpConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *KcpConn) RemoteAddr() net.Addr { return c.remote }
+func (c *KcpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+func (c *KcpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.notifyRead()
+	return nil
+}
+func (c *KcpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	c.notifyWrite()
+	return nil
+}
+
+func (c *KcpConn) notifyRead() {
+	select {
+	case c.readEvent <- struct{}{}:
+	default:
+	}
+}
+
+func (c *KcpConn) notifyWrite() {
+	select {
+	case c.writeEvent <- struct{}{}:
+	default:
+	}
+}
+
+func (c *KcpConn) input(data []byte) error {
+	c.mu.Lock()
+	c.kcp.current = kcpNow()
+	err := c.kcp.input(data)
+	if err == nil {
+		c.lastRecv = time.Now()
+		c.kcp.flush()
+	}
+	c.mu.Unlock()
+	if err == nil {
+		c.notifyRead()
+		c.notifyWrite()
+	}
+	return err
+}
+
+// update flush the conversation, return false once it should be closed
+func (c *KcpConn) update(now uint32, idle time.Duration) bool {
+	c.mu.Lock()
+	c.kcp.update(now)
+	dead := c.kcp.dead
+	lastRecv := c.lastRecv
+	c.mu.Unlock()
+	c.notifyWrite()
+	if dead {
+		return false
+	}
+	return idle <= 0 || time.Since(lastRecv) < idle
+}
+
+func newKcpConn(conv uint32, conn *net.UDPConn, remote *net.UDPAddr) *KcpConn {
+	c := &KcpConn{
+		conn:       conn,
+		remote:     remote,
+		lastRecv:   time.Now(),
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+		closed:     make(chan struct{}),
+	}
+	output := func(b []byte) {
+		var err error
+		if remote == nil {
+			_, err = conn.Write(b)
+		} else {
+			_, err = conn.WriteToUDP(b, remote)
+		}
+		if err != nil {
+			log.Debug("kcp conv:%v output err:%v", conv, err)
+		}
+	}
+	c.kcp = newKcp(conv, output)
+	return c
+}
+
+// KcpListener multiplex kcp conversations over one udp socket
+// every new peer is handed to the Connector as KcpConn
+type KcpListener struct {
+	// IdleTimeout close conversations receiving nothing for this long
+	IdleTimeout time.Duration
+
+	// MaxSessions conversations served at most, new peers over it are dropped
+	MaxSessions int
+
+	udp       *UdpListener
+	handler   Connector
+	admission *Admission
+	mu        sync.Mutex
+	sessions  map[string]*KcpConn
+	quit      chan struct{}
+}
+
+// Udp the underlying datagram server, tune it before ListenAndServe
+func (k *KcpListener) Udp() *UdpListener { return k.udp }
+
+// Addr the local address, empty before serving
+func (k *KcpListener) Addr() string {
+	if addr := k.udp.Addr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+// SetAdmission check the first datagram of every new peer, call before serving
+func (k *KcpListener) SetAdmission(a *Admission) { k.admission = a }
+
+// Count the live conversations
+func (k *KcpListener) Count() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.sessions)
+}
+
+func (k *KcpListener) remove(c *KcpConn) {
+	key := c.remote.String()
+	k.mu.Lock()
+	if k.sessions[key] == c {
+		delete(k.sessions, key)
+	}
+	k.mu.Unlock()
+	if k.admission != nil {
+		k.admission.Release(c.remote)
+	}
+}
+
+// admit a new peer, under mu
+func (k *KcpListener) admit(addr *net.UDPAddr) bool {
+	if k.MaxSessions > 0 && len(k.sessions) >= k.MaxSessions {
+		rejectsTotal.With("kcp", rejectReason(ErrTooManyConns)).Inc()
+		return false
+	}
+	if k.admission != nil {
+		if err := k.admission.Admit(addr); err != nil {
+			log.Debug("kcp reject %v err:%v", addr, err)
+			rejectsTotal.With("kcp", rejectReason(err)).Inc()
+			return false
+		}
+	}
+	acceptsTotal.With("kcp").Inc()
+	return true
+}
+
+func (k *KcpListener) OnDatagram(d *Datagram) {
+	data := d.Data
+	if len(data) < kcpOverhead {
+		return
+	}
+	conv := binary.LittleEndian.Uint32(data)
+	key := d.Addr.String()
+
+	k.mu.Lock()
+	c, ok := k.sessions[key]
+	if !ok || c.Conv() != conv {
+		// a new peer, or one restarted with a new conversation,
+		// the live one is only replaced by an admitted push
+		old := c
+		if ok {
+			delete(k.sessions, key)
+		}
+		if data[4] != kcpCmdPush || !k.admit(d.Addr) {
+			if ok {
+				k.sessions[key] = old
+			}
+			k.mu.Unlock()
+			return
+		}
+		if ok {
+			go old.Close()
+		}
+		addr := *d.Addr
+		c = newKcpConn(conv, d.Conn(), &addr)
+		c.onClose = k.remove
+		k.sessions[key] = c
+		ok = false
+	}
+	k.mu.Unlock()
+
+	if !ok {
+		go k.handler.OnConnect(c)
+	}
+	if err := c.input(data); err != nil {
+		log.Debug("kcp %v input err:%v", key, err)
+	}
+}
+
+func (k *KcpListener) sessionList() []*KcpConn {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	sessions := make([]*KcpConn, 0, len(k.sessions))
+	for _, c := range k.sessions {
+		sessions = append(sessions, c)
+	}
+	return sessions
+}
+
+func (k *KcpListener) updateLoop() {
+	ticker := time.NewTicker(kcpInterval * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-k.quit:
+			return
+		}
+		now := kcpNow()
+		for _, c := range k.sessionList() {
+			if !c.update(now, k.IdleTimeout) {
+				log.Info("kcp %v conv:%v timeout", c.remote, c.Conv())
+				c.Close()
+			}
+		}
+	}
+}
+
+func (k *KcpListener) ListenAndServe(addrStr string, handler Connector, async bool) error {
+	k.handler = handler
+	go k.updateLoop()
+	err := k.udp.ListenAndServe(addrStr, k, async)
+	if err != nil {
+		close(k.quit)
+	}
+	return err
+}
+
+// Close stop serving and close every conversation
+func (k *KcpListener) Close() error {
+	err := k.udp.Close()
+	select {
+	case <-k.quit:
+	default:
+		close(k.quit)
+	}
+	for _, c := range k.sessionList() {
+		c.Close()
+	}
+	return err
+}
+
+func NewKcpListener() *KcpListener {
+	return &KcpListener{
+		IdleTimeout: time.Minute,
+		MaxSessions: DefaultKcpMaxSessions,
+		udp:         NewUdpListener(),
+		sessions:    make(map[string]*KcpConn),
+		quit:        make(chan struct{}),
+	}
+}
+
+// DialKcp connect to a kcp server with a random conversation id
+func DialKcp(addrStr string) (*KcpConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", addrStr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := newKcpConn(rand.Uint32(), conn, nil)
+	c.remote = addr
+	c.onClose = func(*KcpConn) { conn.Close() }
+
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				c.Close()
+				return
+			}
+			c.input(buf[:n])
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(kcpInterval * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !c.update(kcpNow(), 0) {
+					c.Close()
+					return
+				}
+			case <-c.closed:
+				return
+			}
+		}
+	}()
+	return c, nil
+}
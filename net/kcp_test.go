@@ -0,0 +1,196 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKcpLossyLink(t *testing.T) {
+	var a, b *kcp
+	rnd := rand.New(rand.NewSource(1))
+	lossy := func(dst **kcp) func([]byte) {
+		return func(p []byte) {
+			if rnd.Intn(10) < 3 {
+				return
+			}
+			(*dst).input(append([]byte(nil), p...))
+		}
+	}
+	a = newKcp(7, lossy(&b))
+	b = newKcp(7, lossy(&a))
+
+	msgs := [][]byte{
+		[]byte("hello"),
+		bytes.Repeat([]byte{1}, kcpMtu*3),
+		[]byte("world"),
+	}
+	for _, m := range msgs {
+		if err := a.send(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got [][]byte
+	for now := uint32(0); now < 10000 && len(got) < len(msgs); now += kcpInterval {
+		a.update(now)
+		b.update(now)
+		for m := b.recv(); m != nil; m = b.recv() {
+			got = append(got, m)
+		}
+	}
+	if len(got) != len(msgs) {
+		t.Fatalf("got %v messages want %v", len(got), len(msgs))
+	}
+	for i := range msgs {
+		if !bytes.Equal(got[i], msgs[i]) {
+			t.Errorf("message %v mismatch", i)
+		}
+	}
+}
+
+func TestKcpListener(t *testing.T) {
+	c := &wsConnector{packets: make(chanPacketHandler, 1)}
+	l := NewKcpListener()
+	if err := l.ListenAndServe("127.0.0.1:0", c, true); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := DialKcp(l.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	frame := []byte{5, 0, 'a', 'b', 'c'}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-c.packets:
+		if !bytes.Equal(b, frame) {
+			t.Errorf("packet %v want %v", b, frame)
+		}
+	case <-time.After(time.Second):
+		t.Error("packet not delivered")
+	}
+}
+
+func TestKcpMaxSessions(t *testing.T) {
+	c := &wsConnector{packets: make(chanPacketHandler, 4)}
+	l := NewKcpListener()
+	l.MaxSessions = 1
+	if err := l.ListenAndServe("127.0.0.1:0", c, true); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	frame := []byte{5, 0, 'a', 'b', 'c'}
+	for i := 0; i < 2; i++ {
+		conn, err := DialKcp(l.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-c.packets
+	select {
+	case <-c.packets:
+		t.Error("conversation over MaxSessions served")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if n := l.Count(); n != 1 {
+		t.Errorf("sessions %v", n)
+	}
+}
+
+func TestKcpWriteBounded(t *testing.T) {
+	// a peer that never acks
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	conn, err := DialKcp(sink.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	b := make([]byte, 16*1024)
+	for i := 0; ; i++ {
+		if _, err := conn.Write(b); err != nil {
+			if err != ErrKcpTimeout {
+				t.Fatalf("write %v err:%v", i, err)
+			}
+			break
+		}
+		if i > 1000 {
+			t.Fatal("send queue unbounded")
+		}
+	}
+	conn.mu.Lock()
+	wait := conn.kcp.waitSnd()
+	conn.mu.Unlock()
+	if limit := kcpWndSnd*kcpSndQueueFactor + 16*1024/(kcpMtu-kcpOverhead) + 1; wait > limit {
+		t.Errorf("waiting segments %v over %v", wait, limit)
+	}
+}
+
+func TestKcpListenerReplace(t *testing.T) {
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	a, err := NewAdmission(AdmissionConfig{AcceptRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewKcpListener()
+	l.handler = &wsConnector{packets: make(chanPacketHandler, 4)}
+	l.SetAdmission(a)
+	defer l.Close()
+
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000}
+	send := func(conv uint32, cmd byte) {
+		data := make([]byte, kcpOverhead)
+		binary.LittleEndian.PutUint32(data, conv)
+		data[4] = cmd
+		binary.LittleEndian.PutUint16(data[6:], kcpWndRcv)
+		l.OnDatagram(&Datagram{Data: data, Addr: peer, conn: sink})
+	}
+	conv := func() uint32 {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if len(l.sessions) != 1 {
+			return 0
+		}
+		return l.sessions[peer.String()].Conv()
+	}
+
+	send(1, kcpCmdPush)
+	if c := conv(); c != 1 {
+		t.Fatalf("conv %v want 1", c)
+	}
+	// not a push, then a push the admission rejects
+	send(2, kcpCmdAck)
+	send(2, kcpCmdPush)
+	if c := conv(); c != 1 {
+		t.Fatalf("live conversation replaced by %v", c)
+	}
+
+	l.SetAdmission(nil)
+	send(3, kcpCmdPush)
+	if c := conv(); c != 3 {
+		t.Errorf("conv %v want 3", c)
+	}
+}
@@ -1,87 +1,364 @@
 package net
 
 import (
+	"context"
 	"net"
+	"sync"
+	"time"
+
+	"github.com/zerak/ego/log"
+)
+
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
 )
 
 type Listener interface {
 	// ListenAndServe listen on addrStr and serve
-	ListenAndServe(addrStr string, handler Connector) error
+	ListenAndServe(addrStr string, handler Connector, async bool) error
+
+	// Close stop accepting and close active connections
+	Close() error
 }
 
-type TcpListener struct {
+// TcpOptions socket options of TcpListener
+type TcpOptions struct {
+	// Network tcp4 tcp6 tcp(dual stack) or unix
+	Network string
+
+	// NoDelay set TCP_NODELAY on accepted connections
+	NoDelay bool
+
+	// KeepAlive keepalive period, 0 system default, negative disable
+	KeepAlive time.Duration
+
+	// ReadBuffer WriteBuffer SO_RCVBUF SO_SNDBUF, 0 keep system default
+	ReadBuffer  int
+	WriteBuffer int
+
+	// ReusePort number of SO_REUSEPORT sockets each with its own accept loop
+	ReusePort int
 }
 
-func (t *TcpListener) listen(addrStr string) (net.Listener, error) {
-	addr, err := net.ResolveTCPAddr("tcp4", addrStr)
-	if err != nil {
-		return nil, err
+func DefaultTcpOptions() TcpOptions {
+	return TcpOptions{
+		Network: "tcp4",
+		NoDelay: true,
 	}
-	return net.ListenTCP("tcp", addr)
 }
 
-func (t *TcpListener) serve(listener net.Listener, handler Connector, async bool) error {
-	serveFunc := func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				continue
+type TcpListener struct {
+	admission *Admission
+	proxy     *ProxyProtocol
+	opts      TcpOptions
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	closed    bool
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+// listen take the sockets of addrStr inherited on restart or bind new ones
+func (t *TcpListener) listen(addrStr string) ([]net.Listener, error) {
+	network := t.opts.Network
+	if network == "" {
+		network = "tcp4"
+	}
+	if network == "unix" {
+		listener, err := Listen(network, addrStr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	}
+
+	n := t.opts.ReusePort
+	if n <= 0 {
+		n = 1
+	}
+	lc := net.ListenConfig{KeepAlive: t.opts.KeepAlive}
+	if n > 1 {
+		if reusePortControl == nil {
+			return nil, ErrReusePort
+		}
+		lc.Control = reusePortControl
+	}
+	listeners := make([]net.Listener, 0, n)
+	key := addrStr
+	for i := 0; i < n; i++ {
+		listener, err := listenWith(lc, network, key, addrStr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
 			}
-			go handler.OnConnect(conn)
+			return nil, err
 		}
+		listeners = append(listeners, listener)
+		// bind the rest on the port actually chosen
+		addrStr = listener.Addr().String()
 	}
-	if async {
-		go serveFunc()
+	return listeners, nil
+}
+
+func (t *TcpListener) setOptions(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tc.SetNoDelay(t.opts.NoDelay)
+	// here too as sockets inherited on restart skip the ListenConfig
+	if t.opts.KeepAlive > 0 {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(t.opts.KeepAlive)
+	} else if t.opts.KeepAlive < 0 {
+		tc.SetKeepAlive(false)
+	}
+	if t.opts.ReadBuffer > 0 {
+		tc.SetReadBuffer(t.opts.ReadBuffer)
+	}
+	if t.opts.WriteBuffer > 0 {
+		tc.SetWriteBuffer(t.opts.WriteBuffer)
+	}
+}
+
+// Closed whether Close or Shutdown was called
+func (t *TcpListener) Closed() bool { return t.isClosed() }
+
+func (t *TcpListener) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+func (t *TcpListener) track(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *TcpListener) untrack(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+// admit at accept, behind a proxy only the accept rate and the connection count
+// as the client address is known once the header is read, see admitSource
+func (t *TcpListener) admit(conn net.Conn) bool {
+	if t.admission == nil {
+		return true
+	}
+	var err error
+	if t.proxy != nil {
+		err = t.admission.Reserve(conn.RemoteAddr())
 	} else {
-		serveFunc()
+		err = t.admission.Admit(conn.RemoteAddr())
 	}
-	return nil
+	if err != nil {
+		log.Warn("tcp %v reject %v err:%v", conn.LocalAddr(), conn.RemoteAddr(), err)
+		rejectsTotal.With("tcp", rejectReason(err)).Inc()
+		return false
+	}
+	return true
 }
 
-func (t *TcpListener) ListenAndServe(addrStr string, handler Connector, async bool) error {
-	listener, err := t.listen(addrStr)
-	if err == nil {
-		err = t.serve(listener, handler, async)
+// admitSource check the client address the proxy reported for conn
+func (t *TcpListener) admitSource(conn, pc net.Conn) bool {
+	if t.admission == nil {
+		return true
 	}
-	return err
+	if err := t.admission.AdmitReserved(conn.RemoteAddr(), pc.RemoteAddr()); err != nil {
+		log.Warn("tcp %v reject %v via %v err:%v", conn.LocalAddr(), pc.RemoteAddr(), conn.RemoteAddr(), err)
+		rejectsTotal.With("tcp", rejectReason(err)).Inc()
+		return false
+	}
+	return true
 }
 
-func NewTcpListener() *TcpListener {
-	return &TcpListener{}
+// unadmit free what admit took on a conn not served
+func (t *TcpListener) unadmit(conn net.Conn) {
+	if t.admission == nil {
+		return
+	}
+	if t.proxy != nil {
+		t.admission.Unreserve(conn.RemoteAddr())
+	} else {
+		t.admission.Release(conn.RemoteAddr())
+	}
 }
 
-type UdpListener struct {
+func (t *TcpListener) release(conn net.Conn) {
+	if t.admission != nil {
+		t.admission.Release(conn.RemoteAddr())
+	}
 }
 
-func (u *UdpListener) listen(addrStr string) (*net.UDPConn, error) {
-	addr, err := net.ResolveUDPAddr("udp4", addrStr)
-	if err != nil {
-		return nil, err
+func (t *TcpListener) handle(conn net.Conn, handler Connector) {
+	defer t.untrack(conn)
+	if t.proxy != nil {
+		// admit by the client address the proxy reported
+		pc, err := t.proxy.Wrap(conn)
+		if err != nil {
+			log.Warn("tcp %v proxy header from %v err:%v", conn.LocalAddr(), conn.RemoteAddr(), err)
+			rejectsTotal.With("tcp", rejectReason(err)).Inc()
+			t.unadmit(conn)
+			conn.Close()
+			return
+		}
+		if !t.admitSource(conn, pc) {
+			conn.Close()
+			return
+		}
+		conn = pc
+	}
+	defer t.release(conn)
+	handler.OnConnect(conn)
+}
+
+func (t *TcpListener) serve(listener net.Listener, handler Connector) error {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if t.isClosed() {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = minAcceptDelay
+				} else if delay *= 2; delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				log.Warn("tcp %v accept err:%v retry in %v", listener.Addr(), err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			log.Error("tcp %v accept err:%v", listener.Addr(), err)
+			return err
+		}
+		delay = 0
+		acceptsTotal.With("tcp").Inc()
+		t.setOptions(conn)
+		if !t.admit(conn) {
+			conn.Close()
+			continue
+		}
+		if !t.track(conn) {
+			t.unadmit(conn)
+			conn.Close()
+			return nil
+		}
+		go t.handle(conn, handler)
 	}
-	conn, err := net.ListenUDP("udp", addr)
-	return conn, err
 }
 
-func (u *UdpListener) ListenAndServe(addrStr string, handler func(*net.UDPConn), async bool) error {
-	conn, err := u.listen(addrStr)
+// SetOptions set socket options, call before ListenAndServe
+func (t *TcpListener) SetOptions(opts TcpOptions) { t.opts = opts }
+
+// SetProxyProtocol parse PROXY headers on accepted connections
+// call before ListenAndServe
+func (t *TcpListener) SetProxyProtocol(p *ProxyProtocol) { t.proxy = p }
+
+// SetAdmission limit accepted connections, call before ListenAndServe
+func (t *TcpListener) SetAdmission(a *Admission) { t.admission = a }
+
+// Admission the admission control, nil if unlimited
+func (t *TcpListener) Admission() *Admission { return t.admission }
+
+func (t *TcpListener) ListenAndServe(addrStr string, handler Connector, async bool) error {
+	listeners, err := t.listen(addrStr)
 	if err != nil {
 		return err
 	}
+	t.mu.Lock()
+	t.listeners = listeners
+	t.mu.Unlock()
 
-	serveFunc := func() {
-		defer conn.Close()
-		for {
-			handler(conn)
-		}
+	for _, listener := range listeners[1:] {
+		go t.serve(listener, handler)
 	}
 	if async {
-		go serveFunc()
-	} else {
-		serveFunc()
+		go t.serve(listeners[0], handler)
+		return nil
+	}
+	return t.serve(listeners[0], handler)
+}
+
+// Addr the local address, nil before serving
+func (t *TcpListener) Addr() net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.listeners) == 0 {
+		return nil
+	}
+	return t.listeners[0].Addr()
+}
+
+// Count number of active connections
+func (t *TcpListener) Count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+func (t *TcpListener) stopAccept() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.closed = true
+		for _, listener := range t.listeners {
+			listener.Close()
+		}
+	}
+}
+
+func (t *TcpListener) closeConns() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for conn := range t.conns {
+		conn.Close()
 	}
+}
+
+// Close stop accepting, close active connections and wait for them drained
+func (t *TcpListener) Close() error {
+	t.stopAccept()
+	t.closeConns()
+	t.wg.Wait()
 	return nil
 }
 
-func NewUdpListener() *UdpListener {
-	return &UdpListener{}
+// Shutdown stop accepting and wait for active connections drained
+// connections still alive when ctx is done are closed
+func (t *TcpListener) Shutdown(ctx context.Context) error {
+	t.stopAccept()
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		log.Warn("tcp shutdown timeout, close %v connections", t.Count())
+		t.closeConns()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func NewTcpListener() *TcpListener {
+	return &TcpListener{
+		opts:  DefaultTcpOptions(),
+		conns: make(map[net.Conn]struct{}),
+	}
 }
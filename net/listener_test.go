@@ -0,0 +1,134 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type blockConnector struct {
+	connected chan struct{}
+}
+
+func (b *blockConnector) OnConnect(conn net.Conn) {
+	b.connected <- struct{}{}
+	buf := make([]byte, 1)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+func TestTcpListenerShutdown(t *testing.T) {
+	c := &blockConnector{connected: make(chan struct{}, 1)}
+	l := NewTcpListener()
+	if err := l.ListenAndServe("127.0.0.1:0", c, true); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-c.connected
+	if l.Count() != 1 {
+		t.Fatalf("count %v want 1", l.Count())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("shutdown err %v want deadline exceeded", err)
+	}
+	if l.Count() != 0 {
+		t.Errorf("count %v after shutdown", l.Count())
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("listener still accepting")
+	}
+}
+
+func TestTcpListenerOptions(t *testing.T) {
+	for _, opts := range []TcpOptions{
+		{Network: "tcp", ReusePort: 2, ReadBuffer: 64 * 1024},
+		{Network: "unix"},
+	} {
+		c := &blockConnector{connected: make(chan struct{}, 1)}
+		l := NewTcpListener()
+		l.SetOptions(opts)
+		addr := "127.0.0.1:0"
+		if opts.Network == "unix" {
+			addr = filepath.Join(t.TempDir(), "ego.sock")
+		}
+		if err := l.ListenAndServe(addr, c, true); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial(opts.Network, l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-c.connected
+		conn.Close()
+		l.Close()
+	}
+}
+
+// closedByPeer whether the peer closed conn without sending anything
+func closedByPeer(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	return err != nil && !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func TestTcpListenerProxyAdmission(t *testing.T) {
+	a, _ := NewAdmission(AdmissionConfig{MaxConns: 1, Deny: []string{"10.0.0.9"}})
+	p, _ := NewProxyProtocol(ProxyConfig{Trusted: []string{"127.0.0.1"}})
+	c := &blockConnector{connected: make(chan struct{}, 1)}
+	l := NewTcpListener()
+	l.SetAdmission(a)
+	l.SetProxyProtocol(p)
+	if err := l.ListenAndServe("127.0.0.1:0", c, true); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	local := net.IPv4(127, 0, 0, 1)
+
+	// the slot is taken at accept, before the header is read
+	first := dial()
+	defer first.Close()
+	second := dial()
+	defer second.Close()
+	if !closedByPeer(second) {
+		t.Error("connection over max conns not rejected at accept")
+	}
+
+	first.Write(proxyV2Header(net.IPv4(10, 0, 0, 9), local, 1000, 80))
+	if !closedByPeer(first) {
+		t.Error("denied proxy source not rejected")
+	}
+
+	third := dial()
+	defer third.Close()
+	third.Write(proxyV2Header(net.IPv4(10, 0, 0, 1), local, 1000, 80))
+	select {
+	case <-c.connected:
+	case <-time.After(time.Second):
+		t.Fatal("allowed proxy source not served")
+	}
+	if s := a.Stats(); s.Active != 1 || s.TooMany != 1 || s.Denied != 1 {
+		t.Errorf("stats %+v", s)
+	}
+}
@@ -0,0 +1,77 @@
+package net
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"github.com/zerak/ego/metrics"
+	"github.com/zerak/ego/proto"
+)
+
+var (
+	acceptsTotal = metrics.NewCounterVec("ego_listener_accepts_total",
+		"Connections accepted.", "transport")
+	rejectsTotal = metrics.NewCounterVec("ego_listener_rejects_total",
+		"Connections rejected before a session started.", "transport", "reason")
+
+	sessionsActive = metrics.NewGauge("ego_sessions_active",
+		"Sessions running.")
+	sessionBytesIn = metrics.NewCounter("ego_session_read_bytes_total",
+		"Bytes read by sessions.")
+	sessionBytesOut = metrics.NewCounter("ego_session_written_bytes_total",
+		"Bytes written by sessions.")
+	sessionFramesIn = metrics.NewCounter("ego_session_read_frames_total",
+		"Frames read by sessions.")
+	sessionFramesOut = metrics.NewCounter("ego_session_written_frames_total",
+		"Frames written by sessions.")
+	sessionSendQueue = metrics.NewGauge("ego_session_send_queue",
+		"Frames queued by Send and not written yet, over all sessions.")
+	sessionCloses = metrics.NewCounterVec("ego_session_closes_total",
+		"Sessions ended by reason.", "reason")
+	handlerPanics = metrics.NewCounter("ego_handler_panics_total",
+		"Panics recovered in session handlers.")
+)
+
+// rejectReason the label of an admission or proxy protocol error
+func rejectReason(err error) string {
+	switch {
+	case errors.Is(err, ErrDenied):
+		return "denied"
+	case errors.Is(err, ErrRateLimited):
+		return "rate_limited"
+	case errors.Is(err, ErrTooManyConns):
+		return "too_many_conns"
+	case errors.Is(err, ErrTooManyPerIP):
+		return "too_many_per_ip"
+	case errors.Is(err, ErrInvalidRemote):
+		return "invalid_remote"
+	case errors.Is(err, ErrProxyHeader), errors.Is(err, ErrProxyVersion), errors.Is(err, ErrProxyNoHeader):
+		return "proxy_header"
+	}
+	return "error"
+}
+
+// closeReason the label of the error a session ended with
+func closeReason(err error) string {
+	if err == nil {
+		return "quit"
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "timeout"
+	}
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, net.ErrClosed):
+		return "closed"
+	case errors.Is(err, ErrProtocol):
+		return "protocol"
+	case errors.Is(err, ErrFrameRate), errors.Is(err, ErrByteRate):
+		return "flood"
+	case errors.Is(err, ErrFrameTooLarge), errors.Is(err, proto.ErrTooShort),
+		errors.Is(err, ErrFrameFlags), errors.Is(err, ErrDecompressLimit):
+		return "invalid_frame"
+	}
+	return "error"
+}
@@ -0,0 +1,68 @@
+package net
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	buf "github.com/zerak/ego/buffer"
+	"github.com/zerak/ego/proto"
+)
+
+func TestCloseReason(t *testing.T) {
+	cases := map[error]string{
+		nil:                        "quit",
+		io.EOF:                     "eof",
+		ErrProtocol:                "protocol",
+		ErrFrameRate:               "flood",
+		proto.ErrTooShort:          "invalid_frame",
+		ErrKcpTimeout:              "timeout",
+		net.ErrClosed:              "closed",
+		errors.New("connection x"): "error",
+	}
+	for err, want := range cases {
+		if got := closeReason(err); got != want {
+			t.Errorf("%v reason %v want %v", err, got, want)
+		}
+	}
+	if got := rejectReason(ErrTooManyPerIP); got != "too_many_per_ip" {
+		t.Errorf("reject reason %v", got)
+	}
+}
+
+func TestSessionMetrics(t *testing.T) {
+	client, server := net.Pipe()
+	rs := NewReadStream(server, packetHandlerFunc(func([]byte) {}))
+	s := NewRWSession(server, rs, "id", 4)
+
+	closes := sessionCloses.With("eof").Value()
+	framesIn, bytesIn := sessionFramesIn.Value(), sessionBytesIn.Value()
+	framesOut := sessionFramesOut.Value()
+	done := make(chan struct{})
+	go func() {
+		s.Run(nil, nil)
+		close(done)
+	}()
+
+	client.Write([]byte{4, 0, 'h', 'i'})
+	b := buf.NewBuffer()
+	b.WriteString("ok")
+	s.Send(b)
+	out := make([]byte, 2)
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	<-done
+
+	if sessionFramesIn.Value()-framesIn < 1 || sessionBytesIn.Value()-bytesIn < 4 {
+		t.Errorf("frames in %v bytes in %v", sessionFramesIn.Value()-framesIn, sessionBytesIn.Value()-bytesIn)
+	}
+	if sessionFramesOut.Value()-framesOut < 1 {
+		t.Errorf("frames out %v", sessionFramesOut.Value()-framesOut)
+	}
+	if sessionCloses.With("eof").Value()-closes < 1 {
+		t.Errorf("eof closes %v", sessionCloses.With("eof").Value()-closes)
+	}
+}
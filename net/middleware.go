@@ -0,0 +1,85 @@
+package net
+
+import (
+	"github.com/zerak/ego/log"
+	"github.com/zerak/ego/proto"
+)
+
+// ErrFrameTooLarge the same error as proto.ErrFrameTooLarge
+var ErrFrameTooLarge = proto.ErrFrameTooLarge
+
+// FrameFunc process one frame of a session, an error closes the session
+type FrameFunc func(s Session, frame []byte) error
+
+// Middleware wrap next, it may transform the frame or not call next at all
+// inbound middlewares see decrypted frames before the PacketHandler
+// outbound middlewares see plain frames before encryption
+type Middleware func(next FrameFunc) FrameFunc
+
+// Chain build a FrameFunc running mws in order then terminal
+func Chain(terminal FrameFunc, mws ...Middleware) FrameFunc {
+	f := terminal
+	for i := len(mws) - 1; i >= 0; i-- {
+		f = mws[i](f)
+	}
+	return f
+}
+
+// FrameLogger log every frame at debug level
+func FrameLogger(direction string) Middleware {
+	return func(next FrameFunc) FrameFunc {
+		return func(s Session, frame []byte) error {
+			log.Debug("session:%v %v frame size:%v", s.Id(), direction, len(frame))
+			return next(s, frame)
+		}
+	}
+}
+
+// MaxFrameSize reject frames larger than n bytes
+func MaxFrameSize(n int) Middleware {
+	return func(next FrameFunc) FrameFunc {
+		return func(s Session, frame []byte) error {
+			if len(frame) > n {
+				return ErrFrameTooLarge
+			}
+			return next(s, frame)
+		}
+	}
+}
+
+// inboundHandler run the inbound chain in front of the next PacketHandler
+// an owned frame left unchanged by the chain is passed on as is
+type inboundHandler struct {
+	session Session
+	chain   FrameFunc
+	next    PacketHandler
+	onError func(error)
+	cur     *Frame
+}
+
+func (h *inboundHandler) terminal(_ Session, b []byte) error {
+	if f := h.cur; f != nil && sameBytes(f.Bytes(), b) {
+		deliver(h.next, f)
+	} else {
+		h.next.OnPacket(b)
+	}
+	return nil
+}
+
+func (h *inboundHandler) OnPacket(b []byte) {
+	if err := h.chain(h.session, b); err != nil {
+		h.onError(err)
+	}
+}
+
+func (h *inboundHandler) OnFrame(f *Frame) {
+	h.cur = f
+	h.OnPacket(f.Bytes())
+	h.cur = nil
+}
+
+func newInboundHandler(s Session, next PacketHandler, mws []Middleware, onError func(error)) *inboundHandler {
+	h := &inboundHandler{session: s, next: next, onError: onError}
+	h.chain = Chain(h.terminal, mws...)
+	return h
+}
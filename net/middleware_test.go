@@ -0,0 +1,87 @@
+package net
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	buf "github.com/zerak/ego/buffer"
+)
+
+type packetHandlerFunc func([]byte)
+
+func (f packetHandlerFunc) OnPacket(b []byte) { f(b) }
+
+func TestChain(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next FrameFunc) FrameFunc {
+			return func(s Session, frame []byte) error {
+				order = append(order, name)
+				return next(s, append(frame, name...))
+			}
+		}
+	}
+	var got []byte
+	f := Chain(func(s Session, frame []byte) error {
+		got = frame
+		return nil
+	}, mw("a"), mw("b"))
+	if err := f(nil, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "xab" || len(order) != 2 || order[0] != "a" {
+		t.Errorf("frame %q order %v", got, order)
+	}
+
+	errStop := errors.New("stop")
+	stop := func(next FrameFunc) FrameFunc {
+		return func(Session, []byte) error { return errStop }
+	}
+	got = nil
+	f = Chain(func(s Session, frame []byte) error {
+		got = frame
+		return nil
+	}, stop, mw("a"))
+	if err := f(nil, []byte("x")); err != errStop || got != nil {
+		t.Errorf("short circuit err %v frame %q", err, got)
+	}
+}
+
+type bufConn struct {
+	net.Conn
+	out bytes.Buffer
+}
+
+func (c *bufConn) Write(b []byte) (int, error) { return c.out.Write(b) }
+
+func TestSessionMiddleware(t *testing.T) {
+	conn := &bufConn{}
+	var in [][]byte
+	rs := NewReadStream(conn, nil)
+	rs.SetPacketHandler(packetHandlerFunc(func(b []byte) { in = append(in, b) }))
+	s := NewRWSession(conn, rs, "id", 1)
+	s.UseInbound(MaxFrameSize(3))
+	s.UseOutbound(func(next FrameFunc) FrameFunc {
+		return func(s Session, frame []byte) error {
+			return next(s, bytes.ToUpper(frame))
+		}
+	})
+
+	rs.PacketHandler().OnPacket([]byte("abc"))
+	rs.PacketHandler().OnPacket([]byte("abcd"))
+	if len(in) != 1 || !s.getClosed() {
+		t.Errorf("inbound frames %v closed %v", in, s.getClosed())
+	}
+
+	b := buf.NewBuffer()
+	b.WriteString("hi")
+	b.Encrypt = false
+	if err := s.write(b); err != nil {
+		t.Fatal(err)
+	}
+	if conn.out.String() != "HI" {
+		t.Errorf("outbound %q", conn.out.String())
+	}
+}
@@ -0,0 +1,215 @@
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrProxyHeader   = errors.New("invalid proxy protocol header")
+	ErrProxyVersion  = errors.New("unsupported proxy protocol version")
+	ErrProxyNoHeader = errors.New("missing proxy protocol header")
+	ErrProxyTrusted  = errors.New("proxy protocol needs trusted proxies")
+
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+)
+
+const (
+	proxyV1MaxLen       = 107
+	defaultProxyTimeout = 5 * time.Second
+
+	proxyV2HeaderLen = 16
+	proxyV2Version   = 0x20
+	proxyV2CmdLocal  = 0x0
+	proxyV2CmdProxy  = 0x1
+	proxyV2TCP4      = 0x11
+	proxyV2TCP6      = 0x21
+	proxyV2AddrLen4  = 12
+	proxyV2AddrLen6  = 36
+)
+
+// ProxyConfig PROXY protocol v1/v2 parsing on accepted connections
+type ProxyConfig struct {
+	// Trusted CIDR or ip of the proxies, required
+	// headers are only parsed from trusted peers
+	Trusted []string
+
+	// Timeout max time reading the header
+	Timeout time.Duration
+}
+
+// ProxyProtocol parse the PROXY header sent by trusted load balancers
+type ProxyProtocol struct {
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+func (p *ProxyProtocol) isTrusted(addr net.Addr) bool {
+	ip := remoteIP(addr)
+	return ip != nil && containsIP(p.trusted, ip)
+}
+
+// Wrap read the PROXY header of conn and return a conn whose
+// RemoteAddr and LocalAddr are the ones the proxy reported
+// conns from untrusted peers are returned unchanged
+func (p *ProxyProtocol) Wrap(conn net.Conn) (net.Conn, error) {
+	if !p.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	conn.SetReadDeadline(time.Now().Add(p.timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	pc := &proxyConn{Conn: conn, r: bufio.NewReader(conn)}
+	sig, err := pc.r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(sig, proxyV1Prefix):
+		err = pc.readV1()
+	case bytes.Equal(sig, proxyV2Sig[:len(sig)]):
+		err = pc.readV2()
+	default:
+		err = ErrProxyNoHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// no trusted proxy is an error, any client could claim any source address
+func NewProxyProtocol(conf ProxyConfig) (*ProxyProtocol, error) {
+	trusted, err := parseCIDRs(conf.Trusted)
+	if err != nil {
+		return nil, err
+	}
+	if len(trusted) == 0 {
+		return nil, ErrProxyTrusted
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = defaultProxyTimeout
+	}
+	return &ProxyProtocol{trusted: trusted, timeout: conf.Timeout}, nil
+}
+
+// proxyConn a conn behind a proxy, buffered bytes after the header are kept
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readV1 PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func (c *proxyConn) readV1() error {
+	var line []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return ErrProxyHeader
+		}
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return ErrProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return ErrProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil
+	case "TCP4", "TCP6":
+	default:
+		return ErrProxyHeader
+	}
+	if len(fields) != 6 {
+		return ErrProxyHeader
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	sport, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dport, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return ErrProxyHeader
+	}
+	c.remote = &net.TCPAddr{IP: src, Port: int(sport)}
+	c.local = &net.TCPAddr{IP: dst, Port: int(dport)}
+	return nil
+}
+
+func (c *proxyConn) readV2() error {
+	var h [proxyV2HeaderLen]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(h[:len(proxyV2Sig)], proxyV2Sig) {
+		return ErrProxyHeader
+	}
+	if h[12]&0xF0 != proxyV2Version {
+		return ErrProxyVersion
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+
+	switch h[12] & 0x0F {
+	case proxyV2CmdLocal:
+		// health check from the proxy itself
+		return nil
+	case proxyV2CmdProxy:
+	default:
+		return ErrProxyHeader
+	}
+
+	switch h[13] {
+	case proxyV2TCP4:
+		if len(payload) < proxyV2AddrLen4 {
+			return ErrProxyHeader
+		}
+		c.remote = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}
+		c.local = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:]))}
+	case proxyV2TCP6:
+		if len(payload) < proxyV2AddrLen6 {
+			return ErrProxyHeader
+		}
+		c.remote = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}
+		c.local = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:]))}
+	default:
+		// unspec or non tcp, keep the real addresses
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func proxyV2Header(src, dst net.IP, sport, dport uint16) []byte {
+	b := append([]byte(nil), proxyV2Sig...)
+	b = append(b, proxyV2Version|proxyV2CmdProxy, proxyV2TCP4, 0, proxyV2AddrLen4)
+	b = append(b, src.To4()...)
+	b = append(b, dst.To4()...)
+	b = binary.BigEndian.AppendUint16(b, sport)
+	return binary.BigEndian.AppendUint16(b, dport)
+}
+
+// addrConn a pipe end seen as coming from remote
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+var loopback = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+
+func TestProxyProtocol(t *testing.T) {
+	if _, err := NewProxyProtocol(ProxyConfig{}); err != ErrProxyTrusted {
+		t.Errorf("no trusted proxies err %v", err)
+	}
+	p, err := NewProxyProtocol(ProxyConfig{Trusted: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		header []byte
+		remote string
+		err    bool
+	}{
+		{[]byte("PROXY TCP4 1.2.3.4 10.0.0.1 5678 443\r\n"), "1.2.3.4:5678", false},
+		{[]byte("PROXY TCP6 ::1 ::2 5678 443\r\n"), "[::1]:5678", false},
+		{proxyV2Header(net.ParseIP("5.6.7.8"), net.ParseIP("10.0.0.1"), 1234, 443), "5.6.7.8:1234", false},
+		{[]byte("PROXY TCP4 1.2.3.4\r\n"), "", true},
+		{[]byte("GET / HTTP/1.1\r\n"), "", true},
+	}
+	for _, c := range cases {
+		server, client := net.Pipe()
+		go func() {
+			client.Write(append(c.header, "body"...))
+			client.Close()
+		}()
+		conn, err := p.Wrap(&addrConn{Conn: server, remote: loopback})
+		if c.err {
+			if err == nil {
+				t.Errorf("%q want error", c.header)
+			}
+			server.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q err %v", c.header, err)
+			continue
+		}
+		if conn.RemoteAddr().String() != c.remote {
+			t.Errorf("%q remote %v want %v", c.header, conn.RemoteAddr(), c.remote)
+		}
+		body, _ := io.ReadAll(conn)
+		if !bytes.Equal(body, []byte("body")) {
+			t.Errorf("%q body %q", c.header, body)
+		}
+		conn.Close()
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	p, _ := NewProxyProtocol(ProxyConfig{Trusted: []string{"10.0.0.0/8"}})
+	server, client := net.Pipe()
+	defer client.Close()
+	conn, err := p.Wrap(server)
+	if err != nil || conn != server {
+		t.Errorf("untrusted peer should pass through, err %v", err)
+	}
+}
@@ -0,0 +1,227 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/zerak/ego/log"
+)
+
+var (
+	ErrFrameRate = errors.New("inbound frame rate exceeded")
+	ErrByteRate  = errors.New("inbound byte rate exceeded")
+)
+
+// tokenBucket refill rate tokens per second up to burst
+// not safe for concurrent use
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < rate {
+		burst = rate
+	}
+	return &tokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst)}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// take consume n tokens if available
+func (b *tokenBucket) take(now time.Time, n int) bool {
+	if b == nil {
+		return true
+	}
+	b.refill(now)
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// reserve consume n tokens and return how long to wait for them
+func (b *tokenBucket) reserve(now time.Time, n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type FloodAction int
+
+const (
+	// FloodDelay slow down reading until the rate is back under limit
+	FloodDelay FloodAction = iota
+	// FloodDrop discard frames over the limit
+	FloodDrop
+	// FloodDisconnect quit the session
+	FloodDisconnect
+)
+
+func (a FloodAction) String() string {
+	switch a {
+	case FloodDelay:
+		return "delay"
+	case FloodDrop:
+		return "drop"
+	case FloodDisconnect:
+		return "disconnect"
+	}
+	return fmt.Sprintf("FloodAction(%d)", int(a))
+}
+
+// ParseFloodAction parse delay/drop/disconnect, empty means delay
+func ParseFloodAction(s string) (FloodAction, error) {
+	switch s {
+	case "", "delay":
+		return FloodDelay, nil
+	case "drop":
+		return FloodDrop, nil
+	case "disconnect":
+		return FloodDisconnect, nil
+	}
+	return FloodDelay, fmt.Errorf("invalid flood action:%v", s)
+}
+
+// RateLimit inbound limits of one session, zero means unlimited
+type RateLimit struct {
+	FramesPerSecond int
+	BytesPerSecond  int
+
+	// FrameBurst ByteBurst default to the per second limits
+	FrameBurst int
+	ByteBurst  int
+
+	Action FloodAction
+
+	// OnFlood called for every frame over the limit
+	// nil logs at most once per second per session
+	OnFlood func(s Session, err error, action FloodAction)
+}
+
+func (l RateLimit) Enabled() bool {
+	return l.FramesPerSecond > 0 || l.BytesPerSecond > 0
+}
+
+// FloodGuard a PacketHandler applying RateLimit before the real handler
+// or an inbound Middleware, it runs in the read loop of one session
+type FloodGuard struct {
+	handler PacketHandler
+	limit   RateLimit
+	frames  *tokenBucket
+	bytes   *tokenBucket
+	session Session
+	lastLog time.Time
+	flooded uint64
+}
+
+// Bind the session to quit and report on flood
+func (g *FloodGuard) Bind(s Session) { g.session = s }
+
+// Flooded number of frames over the limit
+func (g *FloodGuard) Flooded() uint64 { return atomic.LoadUint64(&g.flooded) }
+
+func (g *FloodGuard) flood(now time.Time, err error) {
+	atomic.AddUint64(&g.flooded, 1)
+	if g.limit.OnFlood != nil {
+		g.limit.OnFlood(g.session, err, g.limit.Action)
+		return
+	}
+	if now.Sub(g.lastLog) < time.Second && g.limit.Action != FloodDisconnect {
+		return
+	}
+	g.lastLog = now
+	id := ""
+	if g.session != nil {
+		id = g.session.Id()
+	}
+	log.Warn("session:%v %v action:%v flooded:%v", id, err, g.limit.Action, g.Flooded())
+}
+
+// admit apply the limit to a frame of n bytes, an error when it must not be handled
+func (g *FloodGuard) admit(n int) error {
+	now := time.Now()
+	if g.limit.Action == FloodDelay {
+		d, err := g.frames.reserve(now, 1), ErrFrameRate
+		if bd := g.bytes.reserve(now, n); bd > d {
+			d, err = bd, ErrByteRate
+		}
+		if d > 0 {
+			g.flood(now, err)
+			time.Sleep(d)
+		}
+		return nil
+	}
+
+	var err error
+	if !g.frames.take(now, 1) {
+		err = ErrFrameRate
+	} else if !g.bytes.take(now, n) {
+		err = ErrByteRate
+	}
+	if err != nil {
+		g.flood(now, err)
+	}
+	return err
+}
+
+func (g *FloodGuard) OnPacket(b []byte) {
+	if err := g.admit(len(b)); err != nil {
+		if g.limit.Action == FloodDisconnect && g.session != nil {
+			g.session.Quit()
+		}
+		return
+	}
+	g.handler.OnPacket(b)
+}
+
+// Middleware the guard as an inbound middleware of its session, the handler is unused
+// it runs on the read goroutine before frames are dispatched
+// so a flooding session is slowed down or cut before its frames are queued
+func (g *FloodGuard) Middleware() Middleware {
+	return func(next FrameFunc) FrameFunc {
+		return func(s Session, frame []byte) error {
+			if g.session == nil {
+				g.session = s
+			}
+			if err := g.admit(len(frame)); err != nil {
+				if g.limit.Action == FloodDisconnect {
+					return err
+				}
+				return nil
+			}
+			return next(s, frame)
+		}
+	}
+}
+
+func NewFloodGuard(handler PacketHandler, limit RateLimit) *FloodGuard {
+	return &FloodGuard{
+		handler: handler,
+		limit:   limit,
+		frames:  newTokenBucket(limit.FramesPerSecond, limit.FrameBurst),
+		bytes:   newTokenBucket(limit.BytesPerSecond, limit.ByteBurst),
+	}
+}
@@ -0,0 +1,76 @@
+package net
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countPacketHandler int
+
+func (c *countPacketHandler) OnPacket([]byte) { *c++ }
+
+func TestFloodGuard(t *testing.T) {
+	var n countPacketHandler
+	flooded := 0
+	g := NewFloodGuard(&n, RateLimit{
+		FramesPerSecond: 2,
+		BytesPerSecond:  100,
+		Action:          FloodDrop,
+		OnFlood: func(s Session, err error, action FloodAction) {
+			flooded++
+		},
+	})
+	g.OnPacket(make([]byte, 10))
+	g.OnPacket(make([]byte, 10))
+	g.OnPacket(make([]byte, 10))
+	if n != 2 || flooded != 1 {
+		t.Errorf("handled %v flooded %v want 2 1", n, flooded)
+	}
+
+	g = NewFloodGuard(&n, RateLimit{BytesPerSecond: 100, Action: FloodDrop})
+	g.OnPacket(make([]byte, 101))
+	if g.Flooded() != 1 {
+		t.Errorf("flooded %v want 1", g.Flooded())
+	}
+}
+
+func TestFloodGuardDispatch(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	release := make(chan struct{})
+	var handled int32
+	rs := NewReadStream(server, packetHandlerFunc(func([]byte) {
+		<-release
+		atomic.AddInt32(&handled, 1)
+	}))
+	s := NewRWSession(server, rs, "id", 1)
+	s.SetDispatcher(NewSessionQueue(8), nil)
+	g := NewFloodGuard(nil, RateLimit{FramesPerSecond: 2, Action: FloodDrop})
+	s.UseInbound(g.Middleware())
+	done := make(chan struct{})
+	go func() {
+		s.Run(nil, nil)
+		close(done)
+	}()
+
+	for i := 0; i < 5; i++ {
+		client.Write([]byte{3, 0, byte(i)})
+	}
+	// dropped while the handler is still blocked on the first frame
+	deadline := time.Now().Add(time.Second)
+	for g.Flooded() != 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if g.Flooded() != 3 || atomic.LoadInt32(&handled) != 0 {
+		t.Errorf("flooded %v handled %v before dispatch", g.Flooded(), atomic.LoadInt32(&handled))
+	}
+	close(release)
+	client.Close()
+	<-done
+	if handled != 2 {
+		t.Errorf("handled %v want 2", handled)
+	}
+}
@@ -0,0 +1,104 @@
+package net
+
+import (
+	"errors"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/zerak/ego/log"
+	"github.com/zerak/ego/proto"
+)
+
+// ErrProtocol close reason of a session whose handler panicked
+var ErrProtocol = errors.New("protocol error")
+
+var (
+	panics  uint64
+	onPanic atomic.Value
+)
+
+// PanicFunc called after a session recovered from a panic
+// name is the message being processed, empty when unknown
+type PanicFunc func(s Session, name string, v interface{}, stack []byte)
+
+// OnPanic set a hook for alerting on session panics
+func OnPanic(fn PanicFunc) { onPanic.Store(fn) }
+
+// Panics number of panics recovered in sessions
+func Panics() uint64 { return atomic.LoadUint64(&panics) }
+
+// frameName message name of a frame for logging
+func frameName(frame []byte) string {
+	if frame == nil {
+		return ""
+	}
+	name, err := proto.DecodeName(frame)
+	if err != nil {
+		return "?"
+	}
+	return name
+}
+
+// recovered log and count a recovered panic then close just that session
+func (ws *WSession) recovered(name string, v interface{}) {
+	stack := debug.Stack()
+	atomic.AddUint64(&panics, 1)
+	handlerPanics.Inc()
+	log.Error("session:%v message:%v panic:%v\n%s", ws.id, name, v, stack)
+	if fn, ok := onPanic.Load().(PanicFunc); ok && fn != nil {
+		fn(ws.self, name, v, stack)
+	}
+	ws.closeWith(ErrProtocol)
+}
+
+// safeHandler the outermost PacketHandler of a RWSession
+// a panic in OnPacket closes the session instead of the process
+type safeHandler struct {
+	ws      *WSession
+	handler PacketHandler
+}
+
+func (h *safeHandler) OnPacket(b []byte) {
+	defer func() {
+		if v := recover(); v != nil {
+			h.ws.recovered(frameName(b), v)
+		}
+	}()
+	h.handler.OnPacket(b)
+}
+
+func (h *safeHandler) OnFrame(f *Frame) {
+	defer func() {
+		if v := recover(); v != nil {
+			h.ws.recovered(frameName(f.Bytes()), v)
+		}
+	}()
+	deliver(h.handler, f)
+}
+
+// OnDatagram keep the sender address for DatagramHandlers
+func (h *safeHandler) OnDatagram(d *Datagram) {
+	defer func() {
+		if v := recover(); v != nil {
+			h.ws.recovered(frameName(d.Data), v)
+		}
+	}()
+	if dh, ok := h.handler.(DatagramHandler); ok {
+		dh.OnDatagram(d)
+		return
+	}
+	h.handler.OnPacket(d.Data)
+}
+
+// call run a Run callback, a panic closes the session
+func (ws *WSession) call(fn func()) {
+	if fn == nil {
+		return
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			ws.recovered("", v)
+		}
+	}()
+	fn()
+}
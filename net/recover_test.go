@@ -0,0 +1,49 @@
+package net
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zerak/ego/proto"
+)
+
+func TestSessionPanic(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	var name string
+	OnPanic(func(s Session, n string, v interface{}, stack []byte) { name = n })
+	defer OnPanic(nil)
+
+	rs := NewReadStream(server, packetHandlerFunc(func(b []byte) { panic("boom") }))
+	s := NewRWSession(server, rs, "id", 1)
+	before, counted := Panics(), handlerPanics.Value()
+	done := make(chan struct{})
+	quit := false
+	go func() {
+		s.Run(nil, func() { quit = true })
+		close(done)
+	}()
+
+	n := proto.DefaultByteNumForLength
+	frame := make([]byte, 2*n+len("login"))
+	proto.EncodeLength(len(frame), frame[:n])
+	proto.EncodeLength(len("login"), frame[n:2*n])
+	copy(frame[2*n:], "login")
+	if _, err := client.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("session not closed after panic")
+	}
+	if handlerPanics.Value()-counted != 1 {
+		t.Errorf("metric counted %v panics", handlerPanics.Value()-counted)
+	}
+	if !quit || s.Reason() != ErrProtocol || Panics() != before+1 || name != "login" {
+		t.Errorf("quit %v reason %v panics %v message %q", quit, s.Reason(), Panics()-before, name)
+	}
+}
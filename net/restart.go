@@ -0,0 +1,283 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// env of a restarted child
+// EGO_LISTEN_FDS the keys of the inherited sockets, fd 3 onwards in order
+// EGO_READY_FD the pipe closed by Ready
+const (
+	envListenFds = "EGO_LISTEN_FDS"
+	envReadyFd   = "EGO_READY_FD"
+)
+
+var (
+	ErrRestartExited = errors.New("restarted process exited before ready")
+	ErrNotInherited  = errors.New("not started by a restart")
+)
+
+// socket a listening socket handed over on restart
+type socket struct {
+	key  string
+	file interface{ File() (*os.File, error) }
+}
+
+// handoff the sockets of this process and the ones inherited from the parent
+var handoff struct {
+	mu        sync.Mutex
+	once      sync.Once
+	sockets   []*socket
+	inherited []*os.File
+	keys      []string
+	ready     *os.File
+}
+
+func socketKey(network, addr string) string { return network + "|" + addr }
+
+// inherit take the sockets the parent passed, once
+func inherit() {
+	handoff.once.Do(func() {
+		if fds := os.Getenv(envListenFds); fds != "" {
+			for i, key := range strings.Split(fds, ",") {
+				handoff.keys = append(handoff.keys, key)
+				handoff.inherited = append(handoff.inherited, os.NewFile(uintptr(3+i), key))
+			}
+		}
+		if fd, err := strconv.Atoi(os.Getenv(envReadyFd)); err == nil {
+			handoff.ready = os.NewFile(uintptr(fd), "ready")
+		}
+		// not for the processes we start
+		os.Unsetenv(envListenFds)
+		os.Unsetenv(envReadyFd)
+	})
+}
+
+// takeInherited the next inherited file of key, nil if none left
+func takeInherited(key string) *os.File {
+	inherit()
+	handoff.mu.Lock()
+	defer handoff.mu.Unlock()
+	for i, k := range handoff.keys {
+		if k == key && handoff.inherited[i] != nil {
+			f := handoff.inherited[i]
+			handoff.inherited[i] = nil
+			return f
+		}
+	}
+	return nil
+}
+
+func addSocket(key string, file interface{ File() (*os.File, error) }) {
+	handoff.mu.Lock()
+	defer handoff.mu.Unlock()
+	handoff.sockets = append(handoff.sockets, &socket{key: key, file: file})
+}
+
+// removeSocket call before closing a socket so a restart does not hand it over
+func removeSocket(file interface{}) {
+	handoff.mu.Lock()
+	defer handoff.mu.Unlock()
+	for i, s := range handoff.sockets {
+		if s.file == file {
+			handoff.sockets = append(handoff.sockets[:i], handoff.sockets[i+1:]...)
+			return
+		}
+	}
+}
+
+// Inherited whether the parent handed sockets to this process
+func Inherited() bool {
+	inherit()
+	return handoff.ready != nil
+}
+
+// sharedListener a listener handed over on restart until closed
+type sharedListener struct {
+	net.Listener
+}
+
+func (l *sharedListener) Close() error {
+	removeSocket(l.Listener)
+	return l.Listener.Close()
+}
+
+// Listen listen on address, or take the socket of the same network and address
+// a restarting parent passed, the socket is handed over on Restart until closed
+func Listen(network, address string) (net.Listener, error) {
+	return listenWith(net.ListenConfig{}, network, address, address)
+}
+
+// listenWith key is the address as configured, address may have the port chosen
+func listenWith(lc net.ListenConfig, network, key, address string) (net.Listener, error) {
+	key = socketKey(network, key)
+	var l net.Listener
+	if f := takeInherited(key); f != nil {
+		var err error
+		l, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherit %v err:%w", key, err)
+		}
+	} else {
+		if network == "unix" {
+			// remove the socket file left by a previous run
+			if fi, err := os.Stat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+				os.Remove(address)
+			}
+		}
+		var err error
+		if l, err = lc.Listen(context.Background(), network, address); err != nil {
+			return nil, err
+		}
+	}
+	f, ok := l.(interface{ File() (*os.File, error) })
+	if !ok {
+		return l, nil
+	}
+	addSocket(key, f)
+	return &sharedListener{Listener: l}, nil
+}
+
+// listenPacketWith the udp counterpart of listenWith
+// call removeSocket before closing the conn
+func listenPacketWith(lc net.ListenConfig, network, key, address string) (*net.UDPConn, error) {
+	key = socketKey(network, key)
+	var pc net.PacketConn
+	if f := takeInherited(key); f != nil {
+		var err error
+		pc, err = net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherit %v err:%w", key, err)
+		}
+	} else {
+		var err error
+		if pc, err = lc.ListenPacket(context.Background(), network, address); err != nil {
+			return nil, err
+		}
+	}
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, fmt.Errorf("%v is not udp", key)
+	}
+	addSocket(key, conn)
+	return conn, nil
+}
+
+// Ready tell the parent this process serves, it then stops accepting and drains
+// inherited sockets not taken by now are closed
+func Ready() error {
+	inherit()
+	handoff.mu.Lock()
+	ready := handoff.ready
+	handoff.ready = nil
+	for i, f := range handoff.inherited {
+		if f != nil {
+			f.Close()
+			handoff.inherited[i] = nil
+		}
+	}
+	handoff.mu.Unlock()
+	if ready == nil {
+		return ErrNotInherited
+	}
+	_, err := ready.Write([]byte{1})
+	ready.Close()
+	return err
+}
+
+// Restart start the executable again with the same arguments and environment
+// handing it every socket made by Listen and the listeners of this package
+// it returns once the child called Ready, the caller should then stop accepting and drain
+// on ctx done or the child exiting first the child is killed and this process serves on
+func Restart(ctx context.Context) (*os.Process, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	handoff.mu.Lock()
+	sockets := append([]*socket(nil), handoff.sockets...)
+	handoff.mu.Unlock()
+	keys := make([]string, 0, len(sockets))
+	files := make([]*os.File, 0, len(sockets)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, s := range sockets {
+		f, err := s.file.File()
+		if err != nil {
+			return nil, fmt.Errorf("socket %v err:%w", s.key, err)
+		}
+		keys = append(keys, s.key)
+		files = append(files, f)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	env := make([]string, 0, len(os.Environ())+2)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envListenFds+"=") && !strings.HasPrefix(kv, envReadyFd+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		envListenFds+"="+strings.Join(keys, ","),
+		envReadyFd+"="+strconv.Itoa(3+len(keys)))
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	// only the child holds the write end now, EOF means it exited
+	w.Close()
+	files = files[:len(files)-1]
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		if n, _ := r.Read(b); n == 1 {
+			ready <- nil
+			return
+		}
+		ready <- ErrRestartExited
+	}()
+	select {
+	case err = <-ready:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return nil, err
+	}
+	// closing ours must not remove the socket file the child serves on
+	for _, s := range sockets {
+		if ul, ok := s.file.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	// reaped by init once we exit, do not wait on it
+	return cmd.Process, nil
+}
@@ -0,0 +1,97 @@
+package net
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+const envRestartChild = "EGO_TEST_RESTART_CHILD"
+
+// TestMain the restart test runs this binary again as the child
+func TestMain(m *testing.M) {
+	if os.Getenv(envRestartChild) != "" {
+		os.Exit(restartChild())
+	}
+	os.Exit(m.Run())
+}
+
+func restartChild() int {
+	if os.Getenv(envRestartChild) == "exit" {
+		return 1
+	}
+	if !Inherited() {
+		return 2
+	}
+	l, err := Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return 3
+	}
+	if err := Ready(); err != nil {
+		return 4
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		return 5
+	}
+	conn.Write([]byte("child"))
+	conn.Close()
+	return 0
+}
+
+func TestRestart(t *testing.T) {
+	if Inherited() {
+		t.Fatal("inherited without a parent")
+	}
+	if err := Ready(); err != ErrNotInherited {
+		t.Errorf("ready err %v", err)
+	}
+	l, err := Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	os.Setenv(envRestartChild, "1")
+	defer os.Unsetenv(envRestartChild)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p, err := Restart(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the child serves on once the parent stopped accepting
+	l.Close()
+
+	conn, err := net.DialTimeout("tcp4", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil || string(b) != "child" {
+		t.Errorf("read %q err:%v", b, err)
+	}
+	if st, err := p.Wait(); err != nil || !st.Success() {
+		t.Errorf("child %v err:%v", st, err)
+	}
+}
+
+func TestRestartChildExit(t *testing.T) {
+	l, err := Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	os.Setenv(envRestartChild, "exit")
+	defer os.Unsetenv(envRestartChild)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := Restart(ctx); err != ErrRestartExited {
+		t.Errorf("restart err %v", err)
+	}
+}
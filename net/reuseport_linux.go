@@ -0,0 +1,4 @@
+package net
+
+// soReusePort SO_REUSEPORT, missing from syscall on some linux arches
+const soReusePort = 0xf
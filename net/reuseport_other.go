@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package net
+
+import (
+	"syscall"
+)
+
+var reusePortControl func(network, address string, c syscall.RawConn) error
@@ -2,6 +2,7 @@ package net
 
 import (
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -21,19 +22,35 @@ type Session interface {
 	SetDecrypt(decrypt DecryptFunc)
 }
 
+// writeReq a frame to send or a change applied in order with frames
+type writeReq struct {
+	b  *buf.Buffer
+	fn func()
+}
+
 // Write Session
 type WSession struct {
 	conn   net.Conn
 	id     string
 	closed int32
 
+	reasonMu sync.Mutex
+	reason   error
+
 	writeQuit chan struct{}
-	writeChan chan *buf.Buffer
+	writeChan chan writeReq
 
-	encryptBuf []byte
+	compression *Compression
+
+	encryptBuf   []byte
+	encryptFrame bool
 
 	encrypt     EncryptFunc
 	encryptChan chan EncryptFunc
+
+	self      Session
+	outbounds []Middleware
+	outbound  FrameFunc
 }
 
 func (ws *WSession) Id() string                     { return ws.id }
@@ -41,24 +58,93 @@ func (ws *WSession) setClosed()                     { atomic.StoreInt32(&ws.clos
 func (ws *WSession) getClosed() bool                { return atomic.LoadInt32(&ws.closed) == 1 }
 func (ws *WSession) SetEncrypt(encrypt EncryptFunc) { ws.encryptChan <- encrypt }
 
+// closeWith close the session, the first reason is kept
+func (ws *WSession) closeWith(err error) {
+	ws.reasonMu.Lock()
+	if ws.reason == nil {
+		ws.reason = err
+	}
+	ws.reasonMu.Unlock()
+	ws.setClosed()
+}
+
+// Reason why the session closed, nil when it quit normally
+func (ws *WSession) Reason() error {
+	ws.reasonMu.Lock()
+	defer ws.reasonMu.Unlock()
+	return ws.reason
+}
+
+// SetDecrypt a write session reads nothing
+func (ws *WSession) SetDecrypt(decrypt DecryptFunc) {}
+
 func (ws *WSession) Send(b *buf.Buffer) {
 	if b.Len() > 0 && !ws.getClosed() {
-		ws.writeChan <- b
+		sessionSendQueue.Inc()
+		ws.writeChan <- writeReq{b: b}
+	}
+}
+
+// SetCompression compress frames sent after the ones already queued
+// nil turns compression off
+func (ws *WSession) SetCompression(c *Compression) {
+	if !ws.getClosed() {
+		ws.writeChan <- writeReq{fn: func() { ws.compression = c }}
 	}
 }
 
+func (ws *WSession) handle(req writeReq) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			name := ""
+			if req.b != nil {
+				name = frameName(req.b.Bytes())
+			}
+			ws.recovered(name, v)
+			err = ErrProtocol
+		}
+	}()
+	if req.fn != nil {
+		req.fn()
+		return nil
+	}
+	sessionSendQueue.Dec()
+	return ws.write(req.b)
+}
+
+// UseOutbound append middlewares on frames sent, call before Run
+func (ws *WSession) UseOutbound(mws ...Middleware) {
+	ws.outbounds = append(ws.outbounds, mws...)
+	ws.outbound = Chain(ws.writeFrame, ws.outbounds...)
+}
+
 func (ws *WSession) write(b *buf.Buffer) (err error) {
-	src := b.Bytes()
-	if encrypt := ws.encrypt; encrypt != nil && b.Encrypt {
+	ws.encryptFrame = b.Encrypt
+	err = ws.outbound(ws.self, b.Bytes())
+	b.Done()
+	return
+}
+
+func (ws *WSession) writeFrame(_ Session, src []byte) (err error) {
+	if c := ws.compression; c != nil {
+		if src, err = c.Encode(src); err != nil {
+			return
+		}
+	}
+	var n int
+	if encrypt := ws.encrypt; encrypt != nil && ws.encryptFrame {
 		if len(ws.encryptBuf) < len(src) {
 			ws.encryptBuf = make([]byte, len(src))
 		}
 		encrypt(ws.encryptBuf, src)
-		_, err = ws.conn.Write(ws.encryptBuf[:len(src)])
+		n, err = ws.conn.Write(ws.encryptBuf[:len(src)])
 	} else {
-		_, err = ws.conn.Write(src)
+		n, err = ws.conn.Write(src)
+	}
+	sessionBytesOut.Add(float64(n))
+	if err == nil {
+		sessionFramesOut.Inc()
 	}
-	b.Done()
 	return
 }
 
@@ -71,10 +157,10 @@ func (ws *WSession) startWriteLoop(startWrite, endWrite chan<- struct{}) {
 			break
 		}
 		select {
-		case b := <-ws.writeChan:
-			err := ws.write(b)
+		case req := <-ws.writeChan:
+			err := ws.handle(req)
 			if err != nil {
-				ws.setClosed()
+				ws.closeWith(err)
 			}
 		case encrypt := <-ws.encryptChan:
 			ws.encrypt = encrypt
@@ -83,28 +169,52 @@ func (ws *WSession) startWriteLoop(startWrite, endWrite chan<- struct{}) {
 	}
 
 	for i := 0; i < remain; i++ {
-		b := <-ws.writeChan
-		err := ws.write(b)
+		req := <-ws.writeChan
+		err := ws.handle(req)
 		if err != nil {
 			break
 		}
 	}
+	ws.discard()
 
 	ws.conn.Close()
 	log.Error("WSession startWriteLoop end")
 	endWrite <- struct{}{}
 }
 
+// discard the frames still queued once the write loop ended
+func (ws *WSession) discard() {
+	for {
+		select {
+		case req := <-ws.writeChan:
+			if req.b != nil {
+				sessionSendQueue.Dec()
+				req.b.Done()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// started count a running session, the returned func records how it ended
+func (ws *WSession) started() func() {
+	sessionsActive.Inc()
+	return func() {
+		sessionsActive.Dec()
+		sessionCloses.With(closeReason(ws.Reason())).Inc()
+	}
+}
+
 func (ws *WSession) Run(onNewSession, onQuitSession func()) {
+	defer ws.started()()
 	startWrite := make(chan struct{})
 	endWrite := make(chan struct{})
 
 	go ws.startWriteLoop(startWrite, endWrite)
 	<-startWrite
 
-	if onNewSession != nil {
-		onNewSession()
-	}
+	ws.call(onNewSession)
 
 	<-endWrite
 
@@ -112,9 +222,7 @@ func (ws *WSession) Run(onNewSession, onQuitSession func()) {
 		ws.conn.Close()
 	}
 
-	if onQuitSession != nil {
-		onQuitSession()
-	}
+	ws.call(onQuitSession)
 }
 
 func (ws *WSession) Quit() {
@@ -126,20 +234,72 @@ func NewWSession(conn net.Conn, id string, conWriteSize int) *WSession {
 	if conWriteSize <= 0 {
 		conWriteSize = 4096
 	}
-	return &WSession{
+	ws := &WSession{
 		conn:        conn,
 		id:          id,
 		writeQuit:   make(chan struct{}),
-		writeChan:   make(chan *buf.Buffer, conWriteSize),
+		writeChan:   make(chan writeReq, conWriteSize),
 		encryptChan: make(chan EncryptFunc, 1),
 		encryptBuf:  make([]byte, 0),
 	}
+	ws.self = ws
+	ws.outbound = ws.writeFrame
+	return ws
 }
 
 // RWSession Read and Write session
 type RWSession struct {
 	*WSession
 	rstream StreamReader
+	safe    *safeHandler
+
+	handler  PacketHandler
+	inbounds []Middleware
+	dispatch *dispatchHandler
+}
+
+// rebuild the handler pipeline: recover, inbound chain, dispatch, handler
+func (s *RWSession) rebuild() {
+	h := s.handler
+	if s.dispatch != nil {
+		s.dispatch.handler = s.handler
+		h = s.dispatch
+	}
+	if len(s.inbounds) > 0 {
+		h = newInboundHandler(s, h, s.inbounds, func(err error) {
+			log.Warn("session:%v inbound err:%v", s.id, err)
+			s.closeWith(err)
+		})
+	}
+	s.safe.handler = h
+}
+
+// SetDispatcher handle frames on d instead of the read goroutine, call before Run
+// key nil orders frames per session, nil d handles inline
+// a SessionQueue is closed when the session ends
+// onQuitSession runs once every dispatched frame was handled
+func (s *RWSession) SetDispatcher(d Dispatcher, key KeyFunc) {
+	s.dispatch = nil
+	if d != nil {
+		if key == nil {
+			key = SessionKey
+		}
+		s.dispatch = &dispatchHandler{session: s, d: d, key: key}
+	}
+	s.rebuild()
+}
+
+// SetHandler handle frames read with h instead of the reader's, call before Run
+func (s *RWSession) SetHandler(h PacketHandler) {
+	s.handler = h
+	s.rebuild()
+}
+
+// UseInbound append middlewares on frames read, call before Run
+// an error returned by the chain closes the session
+func (s *RWSession) UseInbound(mws ...Middleware) {
+	s.inbounds = append(s.inbounds, mws...)
+	s.rebuild()
 }
 
 // SetDecrypt set decrypt function
@@ -147,12 +307,20 @@ func (s *RWSession) SetDecrypt(decrypt DecryptFunc) {
 	s.rstream.SetDecrypt(decrypt)
 }
 
+// SetCompression switch compression after a handshake
+// frames read from now on and frames sent after the queued ones are affected
+// call it from the read loop, e.g. in the PacketHandler of the handshake
+func (s *RWSession) SetCompression(c *Compression) {
+	s.rstream.SetCompression(c)
+	s.WSession.SetCompression(c)
+}
+
 func (s *RWSession) startReadLoop(startRead, endRead chan<- struct{}) {
 	startRead <- struct{}{}
 	for {
-		_, err := s.rstream.Read()
+		err := s.read()
 		if err != nil {
-			s.setClosed()
+			s.closeWith(err)
 		}
 		if s.getClosed() {
 			break
@@ -162,8 +330,25 @@ func (s *RWSession) startReadLoop(startRead, endRead chan<- struct{}) {
 	endRead <- struct{}{}
 }
 
+// read one frame, a panic outside the handler closes the session too
+func (s *RWSession) read() (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			s.recovered("", v)
+			err = ErrProtocol
+		}
+	}()
+	n, err := s.rstream.Read()
+	sessionBytesIn.Add(float64(n))
+	if err == nil && n > 0 {
+		sessionFramesIn.Inc()
+	}
+	return
+}
+
 // Run run session
 func (s *RWSession) Run(onNewSession, onQuitSession func()) {
+	defer s.started()()
 	startRead := make(chan struct{})
 	startWrite := make(chan struct{})
 	endRead := make(chan struct{})
@@ -175,9 +360,7 @@ func (s *RWSession) Run(onNewSession, onQuitSession func()) {
 	<-startRead
 	<-startWrite
 
-	if onNewSession != nil {
-		onNewSession()
-	}
+	s.call(onNewSession)
 
 	<-endRead
 	<-endWrite
@@ -186,15 +369,24 @@ func (s *RWSession) Run(onNewSession, onQuitSession func()) {
 		s.conn.Close()
 	}
 
-	if onQuitSession != nil {
-		onQuitSession()
+	if s.dispatch != nil {
+		if q, ok := s.dispatch.d.(*SessionQueue); ok {
+			q.Close()
+		}
+		s.dispatch.pending.Wait()
 	}
+
+	s.call(onQuitSession)
 }
 
 // NewRWSession new a read and write session
 func NewRWSession(conn net.Conn, rstream StreamReader, id string, conWriteSize int) *RWSession {
 	s := new(RWSession)
 	s.WSession = NewWSession(conn, id, conWriteSize)
+	s.WSession.self = s
 	s.rstream = rstream
+	s.handler = rstream.PacketHandler()
+	s.safe = &safeHandler{ws: s.WSession, handler: s.handler}
+	rstream.SetPacketHandler(s.safe)
 	return s
 }
@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	buf "github.com/zerak/ego/buffer"
 	"github.com/zerak/ego/proto"
 )
 
@@ -13,7 +14,10 @@ type StreamReader interface {
 	Conn() net.Conn
 	Read() (n int, err error)
 	SetDecrypt(decrypt DecryptFunc)
+	SetCompression(c *Compression)
 	SetTimeout(d time.Duration)
+	PacketHandler() PacketHandler
+	SetPacketHandler(h PacketHandler)
 }
 
 type ReadStream struct {
@@ -27,6 +31,9 @@ type ReadStream struct {
 
 	decryptLocker sync.RWMutex
 	decrypt       DecryptFunc
+	compression   *Compression
+
+	pool *buf.Pool
 }
 
 func (r *ReadStream) Conn() net.Conn { return r.conn }
@@ -36,7 +43,7 @@ func (r *ReadStream) Read() (int, error) {
 	if r.timeout > 0 {
 		r.conn.SetReadDeadline(time.Now().Add(r.timeout))
 	}
-	n, err := r.conn.Read(r.buf[:r.byteNumForLength])
+	n, err := io.ReadFull(r.conn, r.buf[:r.byteNumForLength])
 	total += n
 	if err != nil {
 		return total, err
@@ -45,6 +52,7 @@ func (r *ReadStream) Read() (int, error) {
 	// get current decrypt
 	r.decryptLocker.RLock()
 	decrypter := r.decrypt
+	compression := r.compression
 	r.decryptLocker.RUnlock()
 
 	// encrypt packet size
@@ -52,24 +60,34 @@ func (r *ReadStream) Read() (int, error) {
 		decrypter(r.buf[:r.byteNumForLength], r.buf[:r.byteNumForLength])
 	}
 	nextLength := r.decodeLengthFunc(r.buf[:r.byteNumForLength])
-	readedSize := r.byteNumForLength
-	if len(r.buf) < nextLength {
-		r.buf = make([]byte, nextLength)
+	if nextLength < r.byteNumForLength {
+		return total, proto.ErrTooShort
 	}
 
-	// according to packet size parse packet data
-	for readedSize < nextLength {
-		n, err := r.conn.Read(r.buf[readedSize:nextLength])
-		total += n
-		readedSize += n
-		if err != nil {
-			return total, err
-		}
+	// according to packet size read packet data straight into a pooled buffer
+	f := newPoolFrame(r.pool, nextLength)
+	defer f.Release()
+	f.b.Write(r.buf[:r.byteNumForLength])
+	m, err := f.b.ReadFrom(io.LimitReader(r.conn, int64(nextLength-r.byteNumForLength)))
+	total += int(m)
+	if err == nil && f.b.Len() < nextLength {
+		err = io.ErrUnexpectedEOF
 	}
+	if err != nil {
+		return total, err
+	}
+	frame := f.b.Bytes()
 	if decrypter != nil {
-		decrypter(r.buf[r.byteNumForLength:nextLength], r.buf[r.byteNumForLength:nextLength])
+		decrypter(frame[r.byteNumForLength:], frame[r.byteNumForLength:])
+	}
+	if compression != nil {
+		if frame, err = compression.Decode(frame); err != nil {
+			return total, err
+		}
+		f.b.Reset()
+		f.b.Write(frame)
 	}
-	r.packetHandler.OnPacket(r.buf[:nextLength])
+	deliver(r.packetHandler, f)
 	return total, nil
 }
 func (r *ReadStream) SetDecrypt(decrypt DecryptFunc) {
@@ -77,13 +95,28 @@ func (r *ReadStream) SetDecrypt(decrypt DecryptFunc) {
 	defer r.decryptLocker.Unlock()
 	r.decrypt = decrypt
 }
-func (r *ReadStream) SetTimeout(d time.Duration) { r.timeout = d }
+func (r *ReadStream) SetCompression(c *Compression) {
+	if c != nil {
+		cc := *c
+		cc.ByteNumForLength = r.byteNumForLength
+		c = &cc
+	}
+	r.decryptLocker.Lock()
+	defer r.decryptLocker.Unlock()
+	r.compression = c
+}
+func (r *ReadStream) SetTimeout(d time.Duration)       { r.timeout = d }
+func (r *ReadStream) PacketHandler() PacketHandler     { return r.packetHandler }
+func (r *ReadStream) SetPacketHandler(h PacketHandler) { r.packetHandler = h }
 func (r *ReadStream) SetByteNumForLength(n int) {
 	r.byteNumForLength = n
 	if len(r.buf) < n {
 		r.buf = make([]byte, n)
 	}
 }
+
+// SetPool the pool frames are read into, call before reading
+func (r *ReadStream) SetPool(p *buf.Pool) { r.pool = p }
 func (r *ReadStream) SetDecodeLengthFunc(decodeLengthFunc func([]byte) int) {
 	r.decodeLengthFunc = decodeLengthFunc
 }
@@ -92,41 +125,71 @@ func (r *ReadStream) SetDecodeLengthFunc(decodeLengthFunc func([]byte) int) {
 func NewReadStream(conn net.Conn, onPacket PacketHandler) *ReadStream {
 	return &ReadStream{
 		conn:             conn,
-		buf:              make([]byte, 4096),
+		buf:              make([]byte, proto.DefaultByteNumForLength),
 		byteNumForLength: proto.DefaultByteNumForLength,
 		packetHandler:    onPacket,
 		decodeLengthFunc: proto.DecodeLength,
+		pool:             DefaultFramePool(),
 	}
 }
 
 // UDP 包读取
+// handlers implementing DatagramHandler also get the sender address
 type UDPReadStream struct {
 	conn          *net.UDPConn
 	packetHandler PacketHandler
 	buf           []byte
 	timeout       time.Duration
+
+	decryptLocker sync.RWMutex
+	decrypt       DecryptFunc
+	compression   *Compression
 }
 
 func (r *UDPReadStream) Conn() net.Conn { return r.conn }
-func (r *UDPReadStream) Read(encryptFunc EncryptFunc) (int, error) {
-	total := 0
+func (r *UDPReadStream) Read() (int, error) {
 	if r.timeout > 0 {
 		r.conn.SetReadDeadline(time.Now().Add(r.timeout))
 	}
-	n, _, err := r.conn.ReadFromUDP(r.buf)
-	total += n
-	if err != nil && err != io.EOF {
-		return total, err
+	n, addr, err := r.conn.ReadFromUDP(r.buf)
+	if err != nil || n == 0 {
+		return n, err
 	}
-	if n > 0 {
-		r.packetHandler.OnPacket(r.buf[:n])
+
+	r.decryptLocker.RLock()
+	decrypter := r.decrypt
+	compression := r.compression
+	r.decryptLocker.RUnlock()
+	if decrypter != nil {
+		decrypter(r.buf[:n], r.buf[:n])
 	}
-	return total, nil
+	frame := r.buf[:n]
+	if compression != nil {
+		if frame, err = compression.Decode(frame); err != nil {
+			return n, err
+		}
+	}
+
+	if h, ok := r.packetHandler.(DatagramHandler); ok {
+		h.OnDatagram(&Datagram{Data: frame, Addr: addr, conn: r.conn})
+	} else {
+		r.packetHandler.OnPacket(frame)
+	}
+	return n, nil
 }
-func (r *UDPReadStream) SetDecrypter(EncryptFunc) {
-	panic("UDPReadStream unsupport decrypter")
+func (r *UDPReadStream) SetDecrypt(decrypt DecryptFunc) {
+	r.decryptLocker.Lock()
+	defer r.decryptLocker.Unlock()
+	r.decrypt = decrypt
+}
+func (r *UDPReadStream) SetCompression(c *Compression) {
+	r.decryptLocker.Lock()
+	defer r.decryptLocker.Unlock()
+	r.compression = c
 }
-func (r *UDPReadStream) SetTimeout(d time.Duration) { r.timeout = d }
+func (r *UDPReadStream) SetTimeout(d time.Duration)       { r.timeout = d }
+func (r *UDPReadStream) PacketHandler() PacketHandler     { return r.packetHandler }
+func (r *UDPReadStream) SetPacketHandler(h PacketHandler) { r.packetHandler = h }
 
 func NewUDPReadStream(conn *net.UDPConn, onPacket PacketHandler) *UDPReadStream {
 	return &UDPReadStream{
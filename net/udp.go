@@ -0,0 +1,251 @@
+package net
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zerak/ego/log"
+)
+
+var ErrReusePort = errors.New("SO_REUSEPORT unsupported on this platform")
+
+// Datagram one udp packet and its sender
+// Data is only valid until OnDatagram returns
+type Datagram struct {
+	Data []byte
+	Addr *net.UDPAddr
+
+	conn *net.UDPConn
+	buf  []byte
+}
+
+// Conn the socket the datagram was received on
+func (d *Datagram) Conn() *net.UDPConn { return d.conn }
+
+// Reply send b back to the sender through the receiving socket
+func (d *Datagram) Reply(b []byte) (int, error) {
+	return d.conn.WriteToUDP(b, d.Addr)
+}
+
+type DatagramHandler interface {
+	OnDatagram(*Datagram)
+}
+
+type DatagramHandlerFunc func(*Datagram)
+
+func (f DatagramHandlerFunc) OnDatagram(d *Datagram) { f(d) }
+
+type UdpListener struct {
+	// Network udp4 udp6 or udp(dual stack), default udp4
+	Network string
+
+	// ReadBuffer WriteBuffer SO_RCVBUF SO_SNDBUF, 0 keep system default
+	ReadBuffer  int
+	WriteBuffer int
+
+	// PacketSize max datagram size read, larger ones are truncated
+	PacketSize int
+
+	// Sockets number of SO_REUSEPORT sockets bound on the same addr
+	// each one has its own read loop
+	Sockets int
+
+	// Workers number of dispatch goroutines, 0 handle in the read loop
+	// datagrams of the same peer always go to the same worker
+	Workers   int
+	QueueSize int
+
+	mu     sync.Mutex
+	closed bool
+	conns  []*net.UDPConn
+	queues []chan *Datagram
+	readWg sync.WaitGroup
+	workWg sync.WaitGroup
+	pool   sync.Pool
+}
+
+func (u *UdpListener) listen(addrStr string) ([]*net.UDPConn, error) {
+	n := u.Sockets
+	if n <= 0 {
+		n = 1
+	}
+	lc := net.ListenConfig{}
+	if n > 1 {
+		if reusePortControl == nil {
+			return nil, ErrReusePort
+		}
+		lc.Control = reusePortControl
+	}
+
+	network := u.Network
+	if network == "" {
+		network = "udp4"
+	}
+	conns := make([]*net.UDPConn, 0, n)
+	key := addrStr
+	for i := 0; i < n; i++ {
+		conn, err := listenPacketWith(lc, network, key, addrStr)
+		if err != nil {
+			for _, c := range conns {
+				removeSocket(c)
+				c.Close()
+			}
+			return nil, err
+		}
+		if u.ReadBuffer > 0 {
+			conn.SetReadBuffer(u.ReadBuffer)
+		}
+		if u.WriteBuffer > 0 {
+			conn.SetWriteBuffer(u.WriteBuffer)
+		}
+		conns = append(conns, conn)
+		// bind the rest on the port actually chosen
+		addrStr = conn.LocalAddr().String()
+	}
+	return conns, nil
+}
+
+func (u *UdpListener) isClosed() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.closed
+}
+
+func (u *UdpListener) getDatagram(conn *net.UDPConn) *Datagram {
+	d, _ := u.pool.Get().(*Datagram)
+	if d == nil {
+		d = &Datagram{buf: make([]byte, u.PacketSize)}
+	}
+	d.conn = conn
+	return d
+}
+
+func (u *UdpListener) putDatagram(d *Datagram) {
+	d.Data = nil
+	d.Addr = nil
+	d.conn = nil
+	u.pool.Put(d)
+}
+
+func (u *UdpListener) dispatch(d *Datagram, handler DatagramHandler) {
+	if len(u.queues) == 0 {
+		handler.OnDatagram(d)
+		u.putDatagram(d)
+		return
+	}
+	h := fnv.New32a()
+	h.Write(d.Addr.IP)
+	h.Write([]byte{byte(d.Addr.Port), byte(d.Addr.Port >> 8)})
+	u.queues[h.Sum32()%uint32(len(u.queues))] <- d
+}
+
+func (u *UdpListener) work(queue chan *Datagram, handler DatagramHandler) {
+	defer u.workWg.Done()
+	for d := range queue {
+		handler.OnDatagram(d)
+		u.putDatagram(d)
+	}
+}
+
+func (u *UdpListener) serve(conn *net.UDPConn, handler DatagramHandler) {
+	defer u.readWg.Done()
+	var delay time.Duration
+	for {
+		d := u.getDatagram(conn)
+		n, addr, err := conn.ReadFromUDP(d.buf)
+		if err != nil {
+			u.putDatagram(d)
+			if u.isClosed() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// e.g. ICMP errors reported on the socket, back off like accept
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			log.Warn("udp %v read err:%v retry in %v", conn.LocalAddr(), err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		d.Data = d.buf[:n]
+		d.Addr = addr
+		u.dispatch(d, handler)
+	}
+}
+
+// ListenAndServe deliver every datagram received on addrStr to handler
+// it blocks until Close unless async
+func (u *UdpListener) ListenAndServe(addrStr string, handler DatagramHandler, async bool) error {
+	conns, err := u.listen(addrStr)
+	if err != nil {
+		return err
+	}
+	if u.PacketSize <= 0 {
+		u.PacketSize = 8192
+	}
+	if u.QueueSize <= 0 {
+		u.QueueSize = 1024
+	}
+
+	u.mu.Lock()
+	u.conns = conns
+	u.queues = make([]chan *Datagram, u.Workers)
+	for i := range u.queues {
+		u.queues[i] = make(chan *Datagram, u.QueueSize)
+		u.workWg.Add(1)
+		go u.work(u.queues[i], handler)
+	}
+	u.mu.Unlock()
+
+	u.readWg.Add(len(conns))
+	for _, conn := range conns[1:] {
+		go u.serve(conn, handler)
+	}
+	if async {
+		go u.serve(conns[0], handler)
+	} else {
+		u.serve(conns[0], handler)
+	}
+	return nil
+}
+
+// Addr the local address, nil before serving
+func (u *UdpListener) Addr() net.Addr {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.conns) == 0 {
+		return nil
+	}
+	return u.conns[0].LocalAddr()
+}
+
+// Close close the sockets and wait for queued datagrams handled
+func (u *UdpListener) Close() error {
+	u.mu.Lock()
+	if u.closed {
+		u.mu.Unlock()
+		return nil
+	}
+	u.closed = true
+	for _, conn := range u.conns {
+		removeSocket(conn)
+		conn.Close()
+	}
+	u.mu.Unlock()
+
+	u.readWg.Wait()
+	for _, queue := range u.queues {
+		close(queue)
+	}
+	u.workWg.Wait()
+	return nil
+}
+
+func NewUdpListener() *UdpListener {
+	return &UdpListener{}
+}
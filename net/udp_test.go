@@ -0,0 +1,60 @@
+package net
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUdpListener(t *testing.T) {
+	u := NewUdpListener()
+	u.Sockets = 2
+	u.Workers = 4
+	echo := DatagramHandlerFunc(func(d *Datagram) {
+		d.Reply(d.Data)
+	})
+	if err := u.ListenAndServe("127.0.0.1:0", echo, true); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("udp4", u.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	buf := make([]byte, 16)
+	for _, msg := range []string{"ping", "pong"} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg {
+			t.Errorf("reply %q want %q", buf[:n], msg)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		u.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("close blocked")
+	}
+}
+
+func TestUdpListenerNetwork(t *testing.T) {
+	u := NewUdpListener()
+	u.Network = "tcp"
+	if err := u.ListenAndServe("127.0.0.1:0", DatagramHandlerFunc(func(*Datagram) {}), true); err == nil {
+		u.Close()
+		t.Error("listened on a stream network")
+	}
+}
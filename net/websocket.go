@@ -0,0 +1,331 @@
+package net
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/zerak/ego/log"
+	"github.com/zerak/ego/proto"
+)
+
+// WsReadLimit largest websocket message read, the largest tcp frame
+// a larger message closes the connection with ErrFrameTooLarge
+const WsReadLimit = 1<<(uint(proto.DefaultByteNumForLength)<<3) - 1
+
+// WsConn adapt a websocket connection to net.Conn
+// every Write is sent as one binary message
+type WsConn struct {
+	conn   *websocket.Conn
+	reader io.Reader
+}
+
+func (c *WsConn) Read(b []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			mt, r, err := c.conn.NextReader()
+			if err == websocket.ErrReadLimit {
+				return 0, ErrFrameTooLarge
+			}
+			if err != nil {
+				return 0, err
+			}
+			if mt != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = r
+		}
+		n, err := c.reader.Read(b)
+		if err == websocket.ErrReadLimit {
+			return n, ErrFrameTooLarge
+		}
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *WsConn) Write(b []byte) (int, error) {
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *WsConn) Close() error                       { return c.conn.Close() }
+func (c *WsConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *WsConn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *WsConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *WsConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+func (c *WsConn) SetDeadline(t time.Time) error {
+	if err := c.conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.conn.SetWriteDeadline(t)
+}
+
+// Ws the underlying websocket connection
+func (c *WsConn) Ws() *websocket.Conn { return c.conn }
+
+func NewWsConn(conn *websocket.Conn) *WsConn {
+	conn.SetReadLimit(WsReadLimit)
+	return &WsConn{conn: conn}
+}
+
+// WsReadStream deliver every binary message as one packet
+type WsReadStream struct {
+	conn          *WsConn
+	timeout       time.Duration
+	packetHandler PacketHandler
+
+	decryptLocker sync.RWMutex
+	decrypt       DecryptFunc
+	compression   *Compression
+}
+
+func (r *WsReadStream) Conn() net.Conn { return r.conn }
+func (r *WsReadStream) Read() (int, error) {
+	if r.timeout > 0 {
+		r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+	mt, b, err := r.conn.conn.ReadMessage()
+	if err == websocket.ErrReadLimit {
+		return len(b), ErrFrameTooLarge
+	}
+	if err != nil {
+		return 0, err
+	}
+	if mt != websocket.BinaryMessage || len(b) == 0 {
+		return len(b), nil
+	}
+
+	r.decryptLocker.RLock()
+	decrypter := r.decrypt
+	compression := r.compression
+	r.decryptLocker.RUnlock()
+	if decrypter != nil {
+		decrypter(b, b)
+	}
+	n := len(b)
+	if compression != nil {
+		if b, err = compression.Decode(b); err != nil {
+			return n, err
+		}
+	}
+	f := NewFrame(b)
+	deliver(r.packetHandler, f)
+	f.Release()
+	return n, nil
+}
+func (r *WsReadStream) SetDecrypt(decrypt DecryptFunc) {
+	r.decryptLocker.Lock()
+	defer r.decryptLocker.Unlock()
+	r.decrypt = decrypt
+}
+func (r *WsReadStream) SetCompression(c *Compression) {
+	r.decryptLocker.Lock()
+	defer r.decryptLocker.Unlock()
+	r.compression = c
+}
+func (r *WsReadStream) SetTimeout(d time.Duration)       { r.timeout = d }
+func (r *WsReadStream) PacketHandler() PacketHandler     { return r.packetHandler }
+func (r *WsReadStream) SetPacketHandler(h PacketHandler) { r.packetHandler = h }
+
+// websocket 消息读取
+func NewWsReadStream(conn *WsConn, onPacket PacketHandler) *WsReadStream {
+	return &WsReadStream{
+		conn:          conn,
+		packetHandler: onPacket,
+	}
+}
+
+// NewStreamReader new a stream reader matching the transport of conn
+func NewStreamReader(conn net.Conn, onPacket PacketHandler) StreamReader {
+	if ws, ok := conn.(*WsConn); ok {
+		return NewWsReadStream(ws, onPacket)
+	}
+	return NewReadStream(conn, onPacket)
+}
+
+func wsRemoteAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return addr
+}
+
+// WsListener upgrade http requests on path to websocket
+// and hand them to the Connector as WsConn
+type WsListener struct {
+	Upgrader websocket.Upgrader
+
+	path      string
+	handler   Connector
+	admission *Admission
+
+	mu     sync.Mutex
+	server *http.Server
+	closed bool
+	conns  map[*WsConn]struct{}
+	wg     sync.WaitGroup
+}
+
+// Pattern the http path the listener mounted on
+func (w *WsListener) Pattern() string { return w.path }
+
+// Count the live connections
+func (w *WsListener) Count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.conns)
+}
+
+func (w *WsListener) track(conn *WsConn) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false
+	}
+	w.conns[conn] = struct{}{}
+	w.wg.Add(1)
+	return true
+}
+
+// SetAllowedOrigins accept browser clients from these origins on top of the same origin,
+// e.g. "https://game.example.com", "*" accepts any, call before serving
+// requests without an Origin header are not from browsers and always accepted
+func (w *WsListener) SetAllowedOrigins(origins ...string) {
+	allowed := make(map[string]bool, len(origins))
+	for _, o := range origins {
+		allowed[strings.ToLower(strings.TrimSuffix(o, "/"))] = true
+	}
+	w.Upgrader.CheckOrigin = func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || allowed["*"] || allowed[strings.ToLower(origin)] {
+			return true
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+}
+
+// SetAdmission limit upgraded connections, call before serving
+func (w *WsListener) SetAdmission(a *Admission) { w.admission = a }
+
+func (w *WsListener) handle(conn *WsConn) {
+	if w.admission != nil {
+		defer w.admission.Release(conn.RemoteAddr())
+	}
+	defer func() {
+		w.mu.Lock()
+		delete(w.conns, conn)
+		w.mu.Unlock()
+		w.wg.Done()
+	}()
+	w.handler.OnConnect(conn)
+}
+
+func (w *WsListener) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if w.admission != nil {
+		if err := w.admission.Admit(wsRemoteAddr(r)); err != nil {
+			log.Warn("websocket reject %v err:%v", r.RemoteAddr, err)
+			rejectsTotal.With("ws", rejectReason(err)).Inc()
+			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	conn, err := w.Upgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		if w.admission != nil {
+			w.admission.Release(wsRemoteAddr(r))
+		}
+		log.Warn("%v websocket upgrade err:%v", r.RemoteAddr, err)
+		return
+	}
+	acceptsTotal.With("ws").Inc()
+	wc := NewWsConn(conn)
+	if !w.track(wc) {
+		if w.admission != nil {
+			w.admission.Release(wc.RemoteAddr())
+		}
+		wc.Close()
+		return
+	}
+	go w.handle(wc)
+}
+
+func (w *WsListener) ListenAndServe(addrStr string, handler Connector, async bool) error {
+	listener, err := Listen("tcp", addrStr)
+	if err != nil {
+		return err
+	}
+	if handler != nil {
+		w.handler = handler
+	}
+	mux := http.NewServeMux()
+	mux.Handle(w.path, w)
+	server := &http.Server{Handler: mux}
+	w.mu.Lock()
+	w.server = server
+	w.mu.Unlock()
+
+	serveFunc := func() error {
+		err := server.Serve(listener)
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		log.Error("websocket serve %v err:%v", addrStr, err)
+		return err
+	}
+	if async {
+		go serveFunc()
+		return nil
+	}
+	return serveFunc()
+}
+
+// Close stop serving, close active connections and wait for them drained
+func (w *WsListener) Close() error {
+	w.mu.Lock()
+	w.closed = true
+	server := w.server
+	for conn := range w.conns {
+		conn.Close()
+	}
+	w.mu.Unlock()
+
+	var err error
+	if server != nil {
+		err = server.Close()
+	}
+	w.wg.Wait()
+	return err
+}
+
+func NewWsListener(path string, handler Connector) *WsListener {
+	if path == "" {
+		path = "/"
+	}
+	return &WsListener{
+		// same origin only, see SetAllowedOrigins
+		Upgrader: websocket.Upgrader{
+			ReadBufferSize:  4096,
+			WriteBufferSize: 4096,
+		},
+		path:    path,
+		handler: handler,
+		conns:   make(map[*WsConn]struct{}),
+	}
+}
@@ -0,0 +1,126 @@
+package net
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type chanPacketHandler chan []byte
+
+func (c chanPacketHandler) OnPacket(b []byte) {
+	c <- append([]byte(nil), b...)
+}
+
+type wsConnector struct {
+	packets chanPacketHandler
+}
+
+func (c *wsConnector) OnConnect(conn net.Conn) {
+	rs := NewStreamReader(conn, c.packets)
+	for {
+		if _, err := rs.Read(); err != nil {
+			return
+		}
+	}
+}
+
+func TestWsListener(t *testing.T) {
+	c := &wsConnector{packets: make(chanPacketHandler, 1)}
+	srv := httptest.NewServer(NewWsListener("/ws", c))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	frame := []byte{5, 0, 'a', 'b', 'c'}
+	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-c.packets:
+		if !bytes.Equal(b, frame) {
+			t.Errorf("packet %v want %v", b, frame)
+		}
+	case <-time.After(time.Second):
+		t.Error("packet not delivered")
+	}
+}
+
+type wsSessionConnector struct {
+	reason chan error
+}
+
+func (c *wsSessionConnector) OnConnect(conn net.Conn) {
+	rs := NewStreamReader(conn, packetHandlerFunc(func([]byte) {}))
+	s := NewRWSession(conn, rs, "ws", 4)
+	s.Run(nil, func() { c.reason <- s.Reason() })
+}
+
+func TestWsReadLimit(t *testing.T) {
+	c := &wsSessionConnector{reason: make(chan error, 1)}
+	srv := httptest.NewServer(NewWsListener("/ws", c))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, make([]byte, WsReadLimit+1)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-c.reason:
+		if err != ErrFrameTooLarge {
+			t.Errorf("close reason %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("session not closed on an oversized message")
+	}
+}
+
+func TestWsOrigin(t *testing.T) {
+	c := &wsConnector{packets: make(chanPacketHandler, 1)}
+	l := NewWsListener("/ws", c)
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	dial := func(origin string) error {
+		conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {origin}})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	if err := dial(srv.URL); err != nil {
+		t.Errorf("same origin err:%v", err)
+	}
+	if err := dial("https://evil.example"); err == nil {
+		t.Error("cross origin accepted by default")
+	}
+
+	l.SetAllowedOrigins("https://game.example/")
+	if err := dial("https://game.example"); err != nil {
+		t.Errorf("allowed origin err:%v", err)
+	}
+	if err := dial("https://evil.example"); err == nil {
+		t.Error("cross origin accepted")
+	}
+	if err := dial(srv.URL); err != nil {
+		t.Errorf("same origin err:%v", err)
+	}
+}
@@ -6,10 +6,16 @@ import (
 	"io"
 
 	"github.com/golang/protobuf/proto"
+
+	buf "github.com/zerak/ego/buffer"
+	"github.com/zerak/ego/metrics"
 )
 
 const DefaultByteNumForLength = 2
 
+// MaxFrameSize the largest frame the length header can hold
+const MaxFrameSize = 1<<(DefaultByteNumForLength<<3) - 1
+
 type FactoryFunc func() proto.Message
 
 var (
@@ -17,6 +23,11 @@ var (
 
 	ErrTooShort           = errors.New("too short")
 	ErrUnknownMessageName = errors.New("unknown message name")
+	ErrFrameTooLarge      = errors.New("frame too large")
+
+	// message is "unknown" for names not registered, keeping the label set bounded
+	decodeErrors = metrics.NewCounterVec("ego_proto_decode_errors_total",
+		"Frames that failed to decode, by message.", "message")
 )
 
 func DecodeLength(buf []byte) int {
@@ -36,9 +47,21 @@ func EncodeLength(length int, buf []byte) []byte {
 	return buf
 }
 
+// frameSize size of the frame of a message, ErrFrameTooLarge over MaxFrameSize
+func frameSize(name string, bodySize int) (int, error) {
+	n := DefaultByteNumForLength + (DefaultByteNumForLength + len(name)) + bodySize
+	if n > MaxFrameSize {
+		return n, ErrFrameTooLarge
+	}
+	return n, nil
+}
+
 func encodeMessageHeader(w io.Writer, v proto.Message, bodySize int) error {
 	name := proto.MessageName(v)
-	totalSize := DefaultByteNumForLength + (DefaultByteNumForLength + len(name)) + bodySize
+	totalSize, err := frameSize(name, bodySize)
+	if err != nil {
+		return err
+	}
 	// 写包大小
 	if _, err := w.Write(EncodeLength(totalSize, make([]byte, DefaultByteNumForLength))); err != nil {
 		return err
@@ -48,7 +71,7 @@ func encodeMessageHeader(w io.Writer, v proto.Message, bodySize int) error {
 		return err
 	}
 	// 写包名
-	_, err := io.WriteString(w, name)
+	_, err = io.WriteString(w, name)
 	return err
 }
 
@@ -78,25 +101,58 @@ func decodeMessageHeader(b []byte) (n int, name string, err error) {
 	return
 }
 
+// encodeBuffer write the frame into b in one pass, the length header is back-patched
+// nothing is written when the frame is too large
+func encodeBuffer(b *buf.Buffer, v proto.Message, data []byte) error {
+	name := proto.MessageName(v)
+	if _, err := frameSize(name, len(data)); err != nil {
+		return err
+	}
+	off := b.Reserve(DefaultByteNumForLength)
+	b.Write(EncodeLength(len(name), make([]byte, DefaultByteNumForLength)))
+	b.WriteString(name)
+	b.Write(data)
+	header, err := b.Reserved(off, DefaultByteNumForLength)
+	if err == nil {
+		EncodeLength(b.Len()-off, header)
+	}
+	return err
+}
+
+// Encode write v as one frame, ErrFrameTooLarge when it does not fit the length header
 func Encode(w io.Writer, v proto.Message) error {
 	data, err := proto.Marshal(v)
+	if b, ok := w.(*buf.Buffer); ok && err == nil {
+		return encodeBuffer(b, v, data)
+	}
 	if err == nil {
-		encodeMessageHeader(w, v, len(data))
-		_, err = w.Write(data)
+		if err = encodeMessageHeader(w, v, len(data)); err == nil {
+			_, err = w.Write(data)
+		}
 	}
 	return err
 }
 
+// DecodeName get the message name of a frame without decoding the body
+func DecodeName(b []byte) (string, error) {
+	_, name, err := decodeMessageHeader(b)
+	return name, err
+}
+
 func Decode(b []byte) (proto.Message, error) {
 	n, name, err := decodeMessageHeader(b)
 	if err != nil {
+		decodeErrors.With("header").Inc()
 		return nil, err
 	}
 	fn, ok := protocolFactory[name]
 	if !ok {
+		decodeErrors.With("unknown").Inc()
 		return nil, ErrUnknownMessageName
 	}
 	v := fn()
-	err = proto.Unmarshal(b[n:], v)
+	if err = proto.Unmarshal(b[n:], v); err != nil {
+		decodeErrors.With(name).Inc()
+	}
 	return v, err
 }
@@ -0,0 +1,33 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	buf "github.com/zerak/ego/buffer"
+)
+
+func TestEncodeTooLarge(t *testing.T) {
+	v := &wrappers.BytesValue{Value: make([]byte, MaxFrameSize)}
+	b := buf.NewBuffer()
+	if err := Encode(b, v); err != ErrFrameTooLarge {
+		t.Errorf("buffer encode err %v want %v", err, ErrFrameTooLarge)
+	}
+	if b.Len() != 0 {
+		t.Errorf("%v bytes written", b.Len())
+	}
+	var w bytes.Buffer
+	if err := Encode(&w, v); err != ErrFrameTooLarge || w.Len() != 0 {
+		t.Errorf("writer encode err %v wrote %v", err, w.Len())
+	}
+
+	v.Value = v.Value[:1000]
+	if err := Encode(b, v); err != nil {
+		t.Fatal(err)
+	}
+	if n := DecodeLength(b.Bytes()[:DefaultByteNumForLength]); n != b.Len() {
+		t.Errorf("length header %v want %v", n, b.Len())
+	}
+}
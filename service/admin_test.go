@@ -0,0 +1,137 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zerak/ego/config"
+)
+
+type sessionService struct {
+	fakeService
+	n int
+}
+
+func (s *sessionService) Sessions() int { return s.n }
+
+func TestAdmin(t *testing.T) {
+	var got []string
+	app, err := NewApp(WithConfig(config.Server{
+		AdminAddr: "127.0.0.1:0",
+		Db:        map[string]string{"main": "root:secret@tcp(127.0.0.1:3306)/game"},
+		Cache:     map[string]string{"redis": "redis://:pw@127.0.0.1:6379"},
+	}), WithoutLog(), WithAdmin())
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Add(&sessionService{fakeService: fakeService{name: "gate", log: &got}, n: 3})
+	admin := app.Admin()
+
+	get := func(path string, v interface{}) int {
+		w := httptest.NewRecorder()
+		admin.Router().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if v != nil {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatalf("%v %q err:%v", path, w.Body.String(), err)
+			}
+		}
+		return w.Code
+	}
+	if code := get("/readyz", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("readyz before start %v", code)
+	}
+	if err := app.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer app.Stop()
+	if code := get("/readyz", nil); code != http.StatusOK {
+		t.Errorf("readyz %v", code)
+	}
+	if code := get("/healthz", nil); code != http.StatusOK {
+		t.Errorf("healthz %v", code)
+	}
+
+	var sessions struct {
+		Total    int
+		Services map[string]int
+	}
+	get("/sessions", &sessions)
+	if sessions.Total != 3 || sessions.Services["gate"] != 3 {
+		t.Errorf("sessions %+v", sessions)
+	}
+
+	var conf struct {
+		Db    map[string]string
+		Cache map[string]string
+	}
+	get("/config", &conf)
+	if conf.Db["main"] != "root:******@tcp(127.0.0.1:3306)/game" || conf.Cache["redis"] != "redis://:******@127.0.0.1:6379" {
+		t.Errorf("config not masked %+v", conf)
+	}
+	if code := get("/debug/pprof/", nil); code != http.StatusOK {
+		t.Errorf("pprof %v", code)
+	}
+	var pools map[string]interface{}
+	if get("/pools", &pools); pools["pools"] == nil {
+		t.Errorf("pools %v", pools)
+	}
+
+	w := httptest.NewRecorder()
+	admin.Router().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if body := w.Body.String(); !strings.Contains(body, `ego_service_phase_seconds_count{service="gate",phase="start"}`) {
+		t.Errorf("metrics %v %q", w.Code, body)
+	}
+}
+
+func TestAdminAccess(t *testing.T) {
+	a, err := NewAdmin(config.Server{AdminAddr: "0.0.0.0:0"}, NewLifecycle())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Start(); err != ErrAdminExposed {
+		t.Errorf("start on every interface err %v want %v", err, ErrAdminExposed)
+	}
+
+	a, err = NewAdmin(config.Server{
+		AdminAddr:  "0.0.0.0:0",
+		AdminAllow: []string{"192.0.2.0/24"},
+		AdminToken: "t0k",
+	}, NewLifecycle())
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(remote, token string) int {
+		r := httptest.NewRequest("GET", "/build", nil)
+		r.RemoteAddr = remote
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		a.Router().ServeHTTP(w, r)
+		return w.Code
+	}
+	cases := []struct {
+		remote, token string
+		code          int
+	}{
+		{"192.0.2.1:1000", "t0k", http.StatusOK},
+		{"10.0.0.1:1000", "t0k", http.StatusForbidden},
+		{"192.0.2.1:1000", "", http.StatusUnauthorized},
+		{"192.0.2.1:1000", "bad", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		if code := get(c.remote, c.token); code != c.code {
+			t.Errorf("%v token %q code %v want %v", c.remote, c.token, code, c.code)
+		}
+	}
+	if MaskConfig(a.conf)["AdminToken"] != maskedValue {
+		t.Error("admin token not masked")
+	}
+
+	if _, err := NewAdmin(config.Server{AdminAllow: []string{"nope"}}, NewLifecycle()); err == nil {
+		t.Error("invalid allow accepted")
+	}
+}
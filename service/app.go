@@ -0,0 +1,367 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zerak/ego/config"
+	"github.com/zerak/ego/log"
+	"github.com/zerak/ego/net"
+	"github.com/zerak/ego/signal"
+)
+
+// DefaultConfigFile the config file of the -c flag
+const DefaultConfigFile = "./conf/default.conf"
+
+// Option configure an App
+type Option func(a *App)
+
+// WithConfigFile load the config from a file
+func WithConfigFile(path string) Option {
+	return func(a *App) { a.load = func() (config.Server, error) { return config.Load(path) } }
+}
+
+// WithConfigReader load the config from r
+// r is read once, a reload parses the same content again
+func WithConfigReader(r io.Reader) Option {
+	return func(a *App) {
+		var data []byte
+		a.load = func() (config.Server, error) {
+			if data == nil {
+				b, err := io.ReadAll(r)
+				if err != nil {
+					return config.Server{}, err
+				}
+				data = b
+			}
+			return config.LoadReader(bytes.NewReader(data))
+		}
+	}
+}
+
+// WithConfig use conf as is, its empty log options get defaults
+func WithConfig(conf config.Server) Option {
+	return func(a *App) {
+		a.load = func() (config.Server, error) {
+			conf.SetDefaults()
+			return conf, nil
+		}
+	}
+}
+
+// confFilePath the -c flag, registered on flag.CommandLine once for every App
+var (
+	confFlag     sync.Once
+	confFilePath *string
+)
+
+// WithFlags the old behaviour of importing service:
+// parse the command line, load the -c config file into config.Opt
+func WithFlags() Option {
+	return func(a *App) {
+		a.load = func() (config.Server, error) {
+			confFlag.Do(func() {
+				confFilePath = flag.String("c", DefaultConfigFile, " default config file path")
+				flag.Parse()
+			})
+			conf, err := config.Load(*confFilePath)
+			if err == nil {
+				config.Opt = conf
+			}
+			return conf, err
+		}
+	}
+}
+
+// WithoutLog leave logging uninitialized, e.g. in tests
+func WithoutLog() Option {
+	return func(a *App) { a.noLog = true }
+}
+
+// WithServices add services started in order
+func WithServices(services ...Servicer) Option {
+	return func(a *App) { a.services = append(a.services, services...) }
+}
+
+// WithAdmin serve the admin endpoint when the config sets admin addr
+func WithAdmin() Option {
+	return func(a *App) { a.withAdmin = true }
+}
+
+// WithSignals handle the signals of Run with n instead of a new Notifier
+// e.g. to Inject signals in tests
+func WithSignals(n *signal.Notifier) Option {
+	return func(a *App) { a.signals = n }
+}
+
+// WithTimeouts bound the init, start and stop phases, 0 keeps the default
+func WithTimeouts(init, start, stop time.Duration) Option {
+	return func(a *App) {
+		a.lc.InitTimeout = init
+		a.lc.StartTimeout = start
+		a.lc.StopTimeout = stop
+	}
+}
+
+// App load config, init log and run services
+// nothing happens on import, NewApp does it all
+type App struct {
+	mu        sync.RWMutex
+	conf      config.Server
+	load      func() (config.Server, error)
+	noLog     bool
+	withAdmin bool
+	admin     *Admin
+	services  []Servicer
+	lc        *Lifecycle
+	signals   *signal.Notifier
+}
+
+// Admin the admin endpoint, nil unless WithAdmin and admin addr set
+func (a *App) Admin() *Admin { return a.admin }
+
+// Config the loaded config, to build services with
+func (a *App) Config() config.Server {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.conf
+}
+
+// Lifecycle the lifecycle the services run in
+func (a *App) Lifecycle() *Lifecycle { return a.lc }
+
+// Add a service depending on the named ones
+func (a *App) Add(s Servicer, dependsOn ...string) error {
+	return a.lc.Add(s, dependsOn...)
+}
+
+// AddService a Service depending on the named ones
+func (a *App) AddService(s Service, dependsOn ...string) error {
+	return a.lc.AddService(s, dependsOn...)
+}
+
+// Start start the services
+// a process started by Restart then tells its parent to stop accepting and drain
+func (a *App) Start() error {
+	return a.StartContext(context.Background())
+}
+
+// StartContext Start, ctx canceled stops the services started so far
+func (a *App) StartContext(ctx context.Context) error {
+	if err := a.lc.StartContext(ctx); err != nil {
+		return err
+	}
+	if net.Inherited() {
+		if err := net.Ready(); err != nil {
+			log.Error("restart ready err:%v", err)
+		} else {
+			log.Info("restarted, parent draining")
+		}
+	}
+	return nil
+}
+
+func (a *App) Stop() error { return a.lc.Stop() }
+
+// Restart hand the listening sockets to a new process of the same executable
+// and wait until it started its services, then stop the ones here
+// the sessions in progress are drained while the new process accepts
+func (a *App) Restart() error {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		timeoutOr(a.lc.InitTimeout)+timeoutOr(a.lc.StartTimeout))
+	defer cancel()
+	p, err := net.Restart(ctx)
+	if err != nil {
+		return err
+	}
+	log.Info("restarted as pid:%v", p.Pid)
+	return nil
+}
+
+// Reloader a service applying the config reloaded on SIGHUP
+type Reloader interface {
+	Reload(conf config.Server) error
+}
+
+// Reload load the config again, init log with it and hand it to every Reloader
+// the config in use is kept when loading fails
+func (a *App) Reload() error {
+	conf, err := a.load()
+	if err != nil {
+		log.Error("reload config err:%v", err)
+		return err
+	}
+	a.mu.Lock()
+	a.conf = conf
+	a.mu.Unlock()
+	if !a.noLog {
+		log.InitWith(conf)
+	}
+	var first error
+	a.lc.each(func(name string, s interface{}) {
+		r, ok := s.(Reloader)
+		if !ok {
+			return
+		}
+		if err := r.Reload(conf); err != nil {
+			log.Error("service:%v reload err:%v", name, err)
+			if first == nil {
+				first = err
+			}
+		}
+	})
+	log.Info("config reloaded")
+	return first
+}
+
+// ReopenLog reopen the log files, e.g. after logrotate moved them
+func (a *App) ReopenLog() {
+	if !a.noLog {
+		log.Reopen()
+	}
+}
+
+// watchSignals handle the signals of Run until stop is called
+// the first SIGINT or SIGTERM is sent on the returned channel, a second SIGINT forces exit
+// SIGHUP reloads the config and SIGUSR1 reopens the log files
+// SIGUSR2 restarts, the signal is sent on the channel once the new process is ready
+func (a *App) watchSignals() (<-chan os.Signal, func()) {
+	n := a.signals
+	var unregister []func()
+	stopc := make(chan os.Signal, 1)
+	var stopping, restarting int32
+	onStop := func(sig os.Signal) bool {
+		if atomic.CompareAndSwapInt32(&stopping, 0, 1) {
+			stopc <- sig
+		} else if sig == os.Interrupt {
+			log.Error("second interrupt, force exit")
+			a.lc.forceExit()
+		} else {
+			log.Warn("signal %v, already stopping", sig)
+		}
+		return false
+	}
+	for _, sig := range stopSignals {
+		unregister = append(unregister, n.Register(sig, onStop))
+	}
+	if reloadSignal != nil {
+		unregister = append(unregister, n.Register(reloadSignal, func(os.Signal) bool {
+			a.Reload()
+			return false
+		}))
+	}
+	if reopenSignal != nil {
+		unregister = append(unregister, n.Register(reopenSignal, func(os.Signal) bool {
+			log.Info("reopen log")
+			a.ReopenLog()
+			return false
+		}))
+	}
+	if restartSignal != nil {
+		unregister = append(unregister, n.Register(restartSignal, func(sig os.Signal) bool {
+			if atomic.LoadInt32(&stopping) == 1 || !atomic.CompareAndSwapInt32(&restarting, 0, 1) {
+				log.Warn("signal %v, already stopping or restarting", sig)
+				return false
+			}
+			// keep handling signals while the new process starts
+			go func() {
+				defer atomic.StoreInt32(&restarting, 0)
+				if err := a.Restart(); err != nil {
+					log.Error("restart err:%v, serving on", err)
+					return
+				}
+				onStop(sig)
+			}()
+			return false
+		}))
+	}
+	// a Notifier running already calls the handlers too
+	ctx, cancel := context.WithCancel(context.Background())
+	n.Start(ctx)
+	return stopc, func() {
+		for _, u := range unregister {
+			u()
+		}
+		cancel()
+	}
+}
+
+// Run start the services, wait for SIGINT or SIGTERM then stop them gracefully
+// a stop signal while starting cancels the start, the services started are stopped
+// see watchSignals for the other signals handled meanwhile
+func (a *App) Run() error {
+	log.Info("run services")
+	stopc, stop := a.watchSignals()
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan error, 1)
+	go func() { started <- a.StartContext(ctx) }()
+	var sig os.Signal
+	select {
+	case err := <-started:
+		if err != nil {
+			return err
+		}
+		sig = <-stopc
+	case sig = <-stopc:
+		log.Info("signal %v while starting, canceling", sig)
+		cancel()
+		if err := <-started; err != nil {
+			if errors.Is(err, context.Canceled) {
+				log.Info("start canceled, services stopped")
+				return nil
+			}
+			return err
+		}
+	}
+	log.Info("signal %v, stopping services", sig)
+
+	err := a.Stop()
+	log.Info("all services exit")
+	return err
+}
+
+// NewApp without a config option the config is empty with defaults
+func NewApp(opts ...Option) (*App, error) {
+	a := &App{lc: NewLifecycle()}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.signals == nil {
+		a.signals = signal.NewNotifier(0)
+	}
+	if a.load == nil {
+		WithConfig(config.Server{})(a)
+	}
+	conf, err := a.load()
+	if err != nil {
+		return nil, err
+	}
+	a.conf = conf
+	if !a.noLog {
+		log.InitWith(conf)
+	}
+	if a.withAdmin && conf.AdminAddr != "" {
+		if a.admin, err = NewAdmin(conf, a.lc); err != nil {
+			return nil, err
+		}
+		if err := a.lc.Add(a.admin); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range a.services {
+		if err := a.lc.Add(s); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
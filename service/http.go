@@ -1,40 +1,138 @@
 package service
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"sync"
 
 	"github.com/zerak/ego/config"
+	"github.com/zerak/ego/log"
+	"github.com/zerak/ego/net"
 )
 
-type appHandler func(w http.ResponseWriter, r *http.Request) error
+type patternHandler interface {
+	http.Handler
+	Pattern() string
+}
 
 type DefaultHttpServer struct {
-	conf config.Server
+	conf   config.Server
+	router *Router
+
+	mu     sync.Mutex
+	server *http.Server
+	addr   string
 }
 
-func (t DefaultHttpServer) Name() string {
+func (t *DefaultHttpServer) Name() string {
 	return "DefaultHttpServer"
 }
 
-func (t DefaultHttpServer) Init() error {
+func (t *DefaultHttpServer) Init() error {
 	return nil
 }
 
-func (t DefaultHttpServer) Register(h interface{}) error {
-	http.Handle("", h)
+// Register mount h on its Pattern() or on "/"
+// e.g. net.NewWsListener("/ws", connector)
+func (t *DefaultHttpServer) Register(h interface{}) error {
+	switch v := h.(type) {
+	case patternHandler:
+		t.Handle(v.Pattern(), v)
+	case http.Handler:
+		t.Handle("/", v)
+	default:
+		return fmt.Errorf("invalid http handler:%T", h)
+	}
 	return nil
 }
 
-func (t DefaultHttpServer) Start() error {
+// Handle mount h on pattern for any method
+func (t *DefaultHttpServer) Handle(pattern string, h http.Handler) {
+	t.Router().Handle("", pattern, h)
+}
+
+// Router add routes with methods and params, e.g. Router().Get("/users/:id", fn)
+func (t *DefaultHttpServer) Router() *Router {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.router == nil {
+		// a DefaultHttpServer{} not made by NewHttp
+		t.router = NewRouter()
+		t.router.Use(Recover)
+	}
+	return t.router
+}
+
+// Use add middlewares on every route
+func (t *DefaultHttpServer) Use(mws ...HttpMiddleware) { t.Router().Use(mws...) }
+
+// Addr the address listened on once started
+func (t *DefaultHttpServer) Addr() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.addr
+}
+
+func (t *DefaultHttpServer) Start() error {
+	l, err := net.Listen("tcp", t.conf.HttpAddr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:      t.Router(),
+		ReadTimeout:  t.conf.HttpReadTimeout,
+		WriteTimeout: t.conf.HttpWriteTimeout,
+		IdleTimeout:  t.conf.HttpIdleTimeout,
+	}
+	t.mu.Lock()
+	t.server = server
+	t.addr = l.Addr().String()
+	t.mu.Unlock()
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Error("http serve %v err:%v", l.Addr(), err)
+		}
+	}()
 	return nil
 }
 
-func (t DefaultHttpServer) Stop(group *sync.WaitGroup) {
-	group.Done()
+// Stop stop accepting and wait for requests in flight up to drain_timeout,
+// then close the connections left
+func (t *DefaultHttpServer) Stop(group *sync.WaitGroup) {
+	defer group.Done()
+	t.mu.Lock()
+	server := t.server
+	t.server = nil
+	t.mu.Unlock()
+	if server == nil {
+		return
+	}
+	timeout := t.conf.DrainTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warn("http shutdown err:%v", err)
+		server.Close()
+	}
+}
+
+func (t *DefaultHttpServer) Health() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.server == nil {
+		return Status{State: StateStopped}
+	}
+	return Status{State: StateServing, Message: t.addr}
 }
 
-// NewHttp new a http service
-func NewHttp() *DefaultHttpServer {
-	return &DefaultHttpServer{}
+// NewHttp new a http service listening on conf.HttpAddr
+// routes recover from panics
+func NewHttp(conf config.Server) *DefaultHttpServer {
+	router := NewRouter()
+	router.Use(Recover)
+	return &DefaultHttpServer{conf: conf, router: router}
 }
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/zerak/ego/config"
+)
+
+func TestRouter(t *testing.T) {
+	r := NewRouter()
+	r.Use(Recover)
+	r.Get("/users/:id", func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "user "+Param(req, "id"))
+	})
+	r.Get("/users/me", func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "me")
+	})
+	r.Get("/static/*file", func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, Param(req, "file"))
+	})
+	r.HandleApp(http.MethodPost, "/fail", func(w http.ResponseWriter, req *http.Request) error {
+		return NewHttpError(http.StatusBadRequest, "bad input")
+	})
+	r.Get("/panic", func(w http.ResponseWriter, req *http.Request) { panic("boom") })
+
+	cases := []struct {
+		method, path string
+		code         int
+		body         string
+	}{
+		{"GET", "/users/7", 200, "user 7"},
+		{"GET", "/users/me", 200, "me"},
+		{"GET", "/static/js/app.js", 200, "js/app.js"},
+		{"POST", "/users/7", 405, ""},
+		{"GET", "/nothing", 404, ""},
+		{"POST", "/fail", 400, ""},
+		{"GET", "/panic", 500, ""},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+		if w.Code != c.code {
+			t.Errorf("%v %v code %v want %v", c.method, c.path, w.Code, c.code)
+		}
+		if c.body != "" && w.Body.String() != c.body {
+			t.Errorf("%v %v body %q want %q", c.method, c.path, w.Body.String(), c.body)
+		}
+		if c.code == 400 {
+			var e struct {
+				Code  int
+				Error string
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || e.Code != 400 || e.Error != "bad input" {
+				t.Errorf("json error %q err:%v", w.Body.String(), err)
+			}
+		}
+	}
+}
+
+func TestHttpServer(t *testing.T) {
+	s := NewHttp(config.Server{HttpAddr: "127.0.0.1:0"})
+	s.Router().Get("/ping", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "pong") })
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get("http://" + s.Addr() + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "pong" || !s.Health().Healthy() {
+		t.Errorf("body %q health %v", b, s.Health())
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	s.Stop(&wg)
+	wg.Wait()
+	if _, err := http.Get("http://" + s.Addr() + "/ping"); err == nil {
+		t.Errorf("server still serving after Stop")
+	}
+}
+
+func TestHttpDrainTimeout(t *testing.T) {
+	// a zero value server still routes
+	s := &DefaultHttpServer{conf: config.Server{HttpAddr: "127.0.0.1:0", DrainTimeout: 100 * time.Millisecond}}
+	entered := make(chan struct{})
+	s.Router().Get("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		time.Sleep(2 * time.Second)
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go http.Get("http://" + s.Addr() + "/slow")
+	<-entered
+
+	begin := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	s.Stop(&wg)
+	wg.Wait()
+	if d := time.Since(begin); d > time.Second {
+		t.Errorf("stop took %v over drain_timeout", d)
+	}
+}
+
+func TestAccessLogWebsocket(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	r := NewRouter()
+	r.Use(AccessLog)
+	r.Get("/ws", func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mt, b, err := conn.ReadMessage()
+		if err == nil {
+			conn.WriteMessage(mt, b)
+		}
+	})
+	r.Get("/stream", func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "chunk")
+		w.(http.Flusher).Flush()
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("upgrade through AccessLog err:%v", err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, b, err := conn.ReadMessage(); err != nil || string(b) != "ping" {
+		t.Errorf("echo %q err:%v", b, err)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/stream", nil))
+	if !w.Flushed || w.Body.String() != "chunk" {
+		t.Errorf("flushed %v body %q", w.Flushed, w.Body.String())
+	}
+}
@@ -0,0 +1,314 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zerak/ego/log"
+	"github.com/zerak/ego/metrics"
+)
+
+// DefaultPhaseTimeout max time of each init, start and stop phase
+const DefaultPhaseTimeout = 30 * time.Second
+
+var (
+	ErrPhaseTimeout      = errors.New("service phase timeout")
+	ErrDependencyCycle   = errors.New("service dependency cycle")
+	ErrDuplicateService  = errors.New("duplicate service name")
+	ErrUnknownDependency = errors.New("unknown service dependency")
+)
+
+var phaseSeconds = metrics.NewHistogramVec("ego_service_phase_seconds",
+	"Time each service took to init, start and stop.",
+	[]float64{.01, .05, .1, .5, 1, 2.5, 5, 10, 30, 60}, "service", "phase")
+
+// Dependent a Servicer declaring the names of the services it needs started first
+type Dependent interface {
+	DependsOn() []string
+}
+
+type unit struct {
+	s    Service
+	deps []string
+}
+
+// Lifecycle init and start services in dependency order and stop them in reverse
+// services without dependencies keep the order they were added in
+type Lifecycle struct {
+	// InitTimeout StartTimeout StopTimeout bound each whole phase
+	InitTimeout  time.Duration
+	StartTimeout time.Duration
+	StopTimeout  time.Duration
+
+	// OnForceExit called when stopping exceeds StopTimeout or on a second interrupt
+	// in App.Run, default os.Exit(1)
+	OnForceExit func()
+
+	mu      sync.Mutex
+	started []*unit
+
+	regMu  sync.RWMutex
+	units  []*unit
+	byName map[string]*unit
+}
+
+// Add a Servicer depending on the named ones, on top of its DependsOn
+func (l *Lifecycle) Add(s Servicer, dependsOn ...string) error {
+	if d, ok := s.(Dependent); ok {
+		dependsOn = append(dependsOn, d.DependsOn()...)
+	}
+	return l.AddService(Adapt(s), dependsOn...)
+}
+
+// AddService a Service depending on the named ones, on top of its DependsOn
+func (l *Lifecycle) AddService(s Service, dependsOn ...string) error {
+	l.regMu.Lock()
+	defer l.regMu.Unlock()
+	name := s.Name()
+	if _, ok := l.byName[name]; ok {
+		return fmt.Errorf("%w:%v", ErrDuplicateService, name)
+	}
+	deps := append([]string(nil), dependsOn...)
+	if d, ok := s.(Dependent); ok {
+		deps = append(deps, d.DependsOn()...)
+	}
+	u := &unit{s: s, deps: deps}
+	l.units = append(l.units, u)
+	l.byName[name] = u
+	return nil
+}
+
+// order sort the services so every one comes after its dependencies
+func (l *Lifecycle) order() ([]*unit, error) {
+	l.regMu.RLock()
+	defer l.regMu.RUnlock()
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[*unit]int, len(l.units))
+	list := make([]*unit, 0, len(l.units))
+	var visit func(u *unit) error
+	visit = func(u *unit) error {
+		switch state[u] {
+		case visiting:
+			return fmt.Errorf("%w at %v", ErrDependencyCycle, u.s.Name())
+		case done:
+			return nil
+		}
+		state[u] = visiting
+		for _, name := range u.deps {
+			dep, ok := l.byName[name]
+			if !ok {
+				return fmt.Errorf("%w:%v needs %v", ErrUnknownDependency, u.s.Name(), name)
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		state[u] = done
+		list = append(list, u)
+		return nil
+	}
+	for _, u := range l.units {
+		if err := visit(u); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// phase run fn of the named service with ctx and record how long it took
+// fn returning first gives its own result, even when ctx is done meanwhile
+// otherwise the phase fails with ErrPhaseTimeout over its deadline or context.Canceled,
+// fn is left running and late gets its result
+func phase(ctx context.Context, name, step string, fn func(ctx context.Context) error) (late <-chan error, err error) {
+	begin := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- fn(ctx) }()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		late, err = done, ctx.Err()
+	}
+	phaseSeconds.With(name, step).Observe(time.Since(begin).Seconds())
+	if err == context.DeadlineExceeded {
+		err = ErrPhaseTimeout
+	}
+	return late, err
+}
+
+func timeoutOr(d time.Duration) time.Duration {
+	if d <= 0 {
+		return DefaultPhaseTimeout
+	}
+	return d
+}
+
+// Start init every service then start them
+// on the first error the started ones are stopped in reverse order
+// a start over the deadline is waited for up to StopTimeout first,
+// and stopped with them if it succeeded meanwhile
+func (l *Lifecycle) Start() error {
+	return l.StartContext(context.Background())
+}
+
+// StartContext Start, ctx canceled rolls back like a failed start
+func (l *Lifecycle) StartContext(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list, err := l.order()
+	if err != nil {
+		return err
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithTimeout(parent, timeoutOr(l.InitTimeout))
+	defer cancel()
+	for _, u := range list {
+		i, ok := u.s.(interface{ Init() error })
+		if !ok {
+			continue
+		}
+		if _, err := phase(ctx, u.s.Name(), "init", func(context.Context) error { return i.Init() }); err != nil {
+			return fmt.Errorf("service:%v init err:%w", u.s.Name(), err)
+		}
+		log.Info("service:%v init ok", u.s.Name())
+	}
+
+	ctx, cancel = context.WithTimeout(parent, timeoutOr(l.StartTimeout))
+	defer cancel()
+	for _, u := range list {
+		if err := ctx.Err(); err != nil {
+			// the previous start finished as ctx got done, do not start the next ones
+			if err == context.DeadlineExceeded {
+				err = ErrPhaseTimeout
+			}
+			err = fmt.Errorf("service:%v start err:%w", u.s.Name(), err)
+			log.Error("%v, rolling back %v started services", err, len(l.started))
+			l.stop()
+			return err
+		}
+		late, err := phase(ctx, u.s.Name(), "start", u.s.Start)
+		if err != nil {
+			err = fmt.Errorf("service:%v start err:%w", u.s.Name(), err)
+			if late != nil && l.settle(u.s.Name(), late) == nil {
+				l.started = append(l.started, u)
+			}
+			log.Error("%v, rolling back %v started services", err, len(l.started))
+			l.stop()
+			return err
+		}
+		l.started = append(l.started, u)
+		log.Info("service:%v start ok", u.s.Name())
+	}
+	return nil
+}
+
+// settle wait up to StopTimeout for the start of name abandoned at its deadline
+func (l *Lifecycle) settle(name string, late <-chan error) error {
+	t := time.NewTimer(timeoutOr(l.StopTimeout))
+	defer t.Stop()
+	select {
+	case err := <-late:
+		log.Info("service:%v start returned late err:%v", name, err)
+		return err
+	case <-t.C:
+		log.Error("service:%v still starting, not stopped", name)
+		return ErrPhaseTimeout
+	}
+}
+
+// stop the started services in reverse order
+// each gets an equal share of the time left, one over its share is left stopping
+// while the rest are stopped, the process is forced to exit
+// only once StopTimeout passed with a stop still running
+func (l *Lifecycle) stop() error {
+	deadline := time.Now().Add(timeoutOr(l.StopTimeout))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	var first error
+	var late []<-chan error
+	for i := len(l.started) - 1; i >= 0; i-- {
+		s := l.started[i].s
+		share := time.Until(deadline) / time.Duration(i+1)
+		sctx, scancel := context.WithTimeout(ctx, share)
+		ch, err := phase(sctx, s.Name(), "stop", s.Stop)
+		scancel()
+		if err != nil {
+			log.Error("service:%v stop err:%v", s.Name(), err)
+			if ch != nil {
+				late = append(late, ch)
+				continue
+			}
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		log.Info("service:%v stop", s.Name())
+	}
+	l.started = nil
+	for _, ch := range late {
+		select {
+		case err := <-ch:
+			if err != nil && first == nil {
+				first = err
+			}
+		case <-ctx.Done():
+			l.forceExit()
+			return ErrPhaseTimeout
+		}
+	}
+	return first
+}
+
+func (l *Lifecycle) forceExit() {
+	if l.OnForceExit != nil {
+		l.OnForceExit()
+		return
+	}
+	log.Error("services stop timeout, force exit")
+	os.Exit(1)
+}
+
+// Stop stop the started services in reverse order within StopTimeout
+func (l *Lifecycle) Stop() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stop()
+}
+
+// Health status of every service by name
+func (l *Lifecycle) Health() map[string]Status {
+	l.regMu.RLock()
+	units := append([]*unit(nil), l.units...)
+	l.regMu.RUnlock()
+	m := make(map[string]Status, len(units))
+	for _, u := range units {
+		m[u.s.Name()] = u.s.Health()
+	}
+	return m
+}
+
+// each call fn with every service, adapted Servicers unwrapped
+func (l *Lifecycle) each(fn func(name string, s interface{})) {
+	l.regMu.RLock()
+	units := append([]*unit(nil), l.units...)
+	l.regMu.RUnlock()
+	for _, u := range units {
+		var s interface{} = u.s
+		if a, ok := u.s.(*servicerAdapter); ok {
+			s = a.Servicer()
+		}
+		fn(u.s.Name(), s)
+	}
+}
+
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{byName: make(map[string]*unit)}
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zerak/ego/config"
+)
+
+type fakeService struct {
+	name       string
+	deps       []string
+	err        error
+	block      time.Duration
+	startBlock time.Duration
+	onStart    func()
+	log        *[]string
+}
+
+func (f *fakeService) Name() string                 { return f.name }
+func (f *fakeService) Init() error                  { return nil }
+func (f *fakeService) Register(h interface{}) error { return nil }
+func (f *fakeService) DependsOn() []string          { return f.deps }
+func (f *fakeService) Start() error {
+	time.Sleep(f.startBlock)
+	if f.onStart != nil {
+		f.onStart()
+	}
+	if f.err == nil {
+		*f.log = append(*f.log, "start "+f.name)
+	}
+	return f.err
+}
+func (f *fakeService) Stop(wg *sync.WaitGroup) {
+	time.Sleep(f.block)
+	*f.log = append(*f.log, "stop "+f.name)
+	wg.Done()
+}
+
+func TestLifecycleOrder(t *testing.T) {
+	var got []string
+	app, err := NewApp(WithConfig(config.Server{}), WithoutLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Add(&fakeService{name: "gate", deps: []string{"db"}, log: &got})
+	app.Add(&fakeService{name: "db", log: &got})
+	app.Add(&fakeService{name: "cache", log: &got}, "db")
+	if err := app.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if h := app.Lifecycle().Health(); !h["gate"].Healthy() {
+		t.Errorf("health %v", h)
+	}
+	app.Stop()
+	want := "[start db start gate start cache stop cache stop gate stop db]"
+	if s := fmt.Sprint(got); s != want {
+		t.Errorf("got %v want %v", s, want)
+	}
+}
+
+func TestLifecycleRollback(t *testing.T) {
+	var got []string
+	errStart := errors.New("bind failed")
+	lc := NewLifecycle()
+	lc.Add(&fakeService{name: "db", log: &got})
+	lc.Add(&fakeService{name: "gate", err: errStart, log: &got})
+	if err := lc.Start(); !errors.Is(err, errStart) {
+		t.Fatalf("err %v want %v", err, errStart)
+	}
+	if s := fmt.Sprint(got); s != "[start db stop db]" {
+		t.Errorf("got %v", s)
+	}
+
+	lc = NewLifecycle()
+	lc.Add(&fakeService{name: "a", deps: []string{"b"}, log: &got})
+	lc.Add(&fakeService{name: "b", deps: []string{"a"}, log: &got})
+	if err := lc.Start(); !errors.Is(err, ErrDependencyCycle) {
+		t.Errorf("err %v want %v", err, ErrDependencyCycle)
+	}
+}
+
+func TestLifecycleStopTimeout(t *testing.T) {
+	var got, slow []string
+	forced := false
+	lc := NewLifecycle()
+	lc.StopTimeout = 100 * time.Millisecond
+	lc.OnForceExit = func() { forced = true }
+	lc.Add(&fakeService{name: "db", log: &got})
+	lc.Add(&fakeService{name: "slow", block: time.Second, log: &slow})
+	if err := lc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	begin := time.Now()
+	if err := lc.Stop(); err != ErrPhaseTimeout || !forced {
+		t.Errorf("err %v forced %v", err, forced)
+	}
+	if d := time.Since(begin); d < lc.StopTimeout {
+		t.Errorf("forced exit after %v, before the stop timeout", d)
+	}
+	// still stopped after the slow one timed out
+	if s := fmt.Sprint(got); s != "[start db stop db]" {
+		t.Errorf("got %v", s)
+	}
+
+	// a stop over its share but done within StopTimeout is no timeout
+	var got2, late []string
+	forced = false
+	lc = NewLifecycle()
+	lc.StopTimeout = 200 * time.Millisecond
+	lc.OnForceExit = func() { forced = true }
+	lc.Add(&fakeService{name: "db", log: &got2})
+	lc.Add(&fakeService{name: "late", block: 150 * time.Millisecond, log: &late})
+	if err := lc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lc.Stop(); err != nil || forced {
+		t.Errorf("err %v forced %v", err, forced)
+	}
+}
+
+func TestLifecycleStartTimeout(t *testing.T) {
+	var got []string
+	lc := NewLifecycle()
+	lc.StartTimeout = 50 * time.Millisecond
+	lc.Add(&fakeService{name: "db", log: &got})
+	lc.Add(&fakeService{name: "late", startBlock: 100 * time.Millisecond, log: &got})
+	if err := lc.Start(); !errors.Is(err, ErrPhaseTimeout) {
+		t.Fatalf("err %v want %v", err, ErrPhaseTimeout)
+	}
+	// the late start is waited for and rolled back too
+	if s := fmt.Sprint(got); s != "[start db start late stop late stop db]" {
+		t.Errorf("got %v", s)
+	}
+}
+
+func TestLifecycleCancelWhileStarting(t *testing.T) {
+	// cancel racing the end of a start must not lose the started service
+	for i := 0; i < 50; i++ {
+		var got []string
+		ctx, cancel := context.WithCancel(context.Background())
+		lc := NewLifecycle()
+		lc.Add(&fakeService{name: "db", onStart: cancel, log: &got})
+		lc.Add(&fakeService{name: "gate", log: &got})
+		if err := lc.StartContext(ctx); !errors.Is(err, context.Canceled) {
+			t.Fatalf("err %v want %v", err, context.Canceled)
+		}
+		if s := fmt.Sprint(got); s != "[start db stop db]" {
+			t.Fatalf("got %v", s)
+		}
+	}
+}
+
+func TestWithFlagsTwice(t *testing.T) {
+	// the -c flag is registered once, a second App must not panic
+	for i := 0; i < 2; i++ {
+		NewApp(WithFlags(), WithoutLog())
+	}
+	if flag.Lookup("c") == nil {
+		t.Error("-c not registered")
+	}
+}
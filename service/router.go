@@ -0,0 +1,263 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/zerak/ego/log"
+)
+
+// HttpError an error carrying its http status
+type HttpError struct {
+	Code    int
+	Message string
+}
+
+func (e *HttpError) Error() string { return e.Message }
+
+// NewHttpError e.g. return NewHttpError(http.StatusBadRequest, "invalid id")
+func NewHttpError(code int, msg string) error {
+	return &HttpError{Code: code, Message: msg}
+}
+
+// WriteError write err as {"code":..,"error":".."}
+// errors other than HttpError are 500
+func WriteError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	var he *HttpError
+	if errors.As(err, &he) {
+		code = he.Code
+	}
+	WriteJSON(w, code, map[string]interface{}{"code": code, "error": err.Error()})
+}
+
+// WriteJSON write v as a json response
+func WriteJSON(w http.ResponseWriter, code int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	return json.NewEncoder(w).Encode(v)
+}
+
+type appHandler func(w http.ResponseWriter, r *http.Request) error
+
+func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := fn(w, r); err != nil {
+		WriteError(w, err)
+	}
+}
+
+// HttpMiddleware wrap every routed handler
+type HttpMiddleware func(next http.Handler) http.Handler
+
+// Recover answer 500 instead of dropping the connection on a handler panic
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				log.Error("http %v %v panic:%v\n%s", r.Method, r.URL.Path, v, debug.Stack())
+				WriteError(w, NewHttpError(http.StatusInternalServerError, "internal error"))
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush for streamed responses
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack for websocket upgrades, the upgrade is logged as 101
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		w.code = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap for http.ResponseController
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// AccessLog log every request at debug level
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		log.Debug("http %v %v %v %v %v", r.RemoteAddr, r.Method, r.URL.Path, sw.code, time.Since(start))
+	})
+}
+
+type paramsKey struct{}
+
+// Param the value of :name or *name in the route of r
+func Param(r *http.Request, name string) string {
+	params, _ := r.Context().Value(paramsKey{}).(map[string]string)
+	return params[name]
+}
+
+type route struct {
+	method   string
+	segments []string
+	prefix   bool
+	handler  http.Handler
+}
+
+// match the params of path and a score, more static segments score higher
+func (rt *route) match(parts []string) (map[string]string, int, bool) {
+	var params map[string]string
+	score := 0
+	for i, seg := range rt.segments {
+		if strings.HasPrefix(seg, "*") {
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[seg[1:]] = strings.Join(parts[i:], "/")
+			return params, score, true
+		}
+		if i >= len(parts) {
+			return nil, 0, false
+		}
+		switch {
+		case strings.HasPrefix(seg, ":"):
+			if parts[i] == "" {
+				return nil, 0, false
+			}
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[seg[1:]] = parts[i]
+			score++
+		case seg == parts[i]:
+			score += 2
+		default:
+			return nil, 0, false
+		}
+	}
+	if len(parts) > len(rt.segments) && !rt.prefix {
+		return nil, 0, false
+	}
+	return params, score, true
+}
+
+func splitPath(p string) []string {
+	return strings.Split(strings.Trim(p, "/"), "/")
+}
+
+// Router routes by method and path, register routes before serving
+// /users/:id matches one segment, /static/*file the rest of the path
+// a pattern ending with / matches every path under it like http.ServeMux
+type Router struct {
+	routes      []*route
+	middlewares []HttpMiddleware
+	handler     http.Handler
+}
+
+// Handle route method and pattern to h, an empty method matches any
+func (rt *Router) Handle(method, pattern string, h http.Handler) {
+	r := &route{
+		method:   strings.ToUpper(method),
+		segments: splitPath(pattern),
+		prefix:   strings.HasSuffix(pattern, "/") && pattern != "/",
+		handler:  h,
+	}
+	if pattern == "/" {
+		r.segments, r.prefix = nil, true
+	}
+	if r.prefix && len(r.segments) == 1 && r.segments[0] == "" {
+		r.segments = nil
+	}
+	rt.routes = append(rt.routes, r)
+}
+
+func (rt *Router) HandleFunc(method, pattern string, fn http.HandlerFunc) {
+	rt.Handle(method, pattern, fn)
+}
+
+// HandleApp route an error returning handler, errors are written as json
+func (rt *Router) HandleApp(method, pattern string, fn func(w http.ResponseWriter, r *http.Request) error) {
+	rt.Handle(method, pattern, appHandler(fn))
+}
+
+func (rt *Router) Get(pattern string, fn http.HandlerFunc)  { rt.Handle(http.MethodGet, pattern, fn) }
+func (rt *Router) Post(pattern string, fn http.HandlerFunc) { rt.Handle(http.MethodPost, pattern, fn) }
+
+// Use add middlewares, the first one runs first
+func (rt *Router) Use(mws ...HttpMiddleware) {
+	rt.middlewares = append(rt.middlewares, mws...)
+	var h http.Handler = http.HandlerFunc(rt.route)
+	for i := len(rt.middlewares) - 1; i >= 0; i-- {
+		h = rt.middlewares[i](h)
+	}
+	rt.handler = h
+}
+
+func (rt *Router) route(w http.ResponseWriter, r *http.Request) {
+	parts := splitPath(r.URL.Path)
+	var best *route
+	var bestParams map[string]string
+	bestScore := -1
+	var allow []string
+	for _, rte := range rt.routes {
+		params, score, ok := rte.match(parts)
+		if !ok {
+			continue
+		}
+		if rte.method != "" && rte.method != r.Method {
+			allow = append(allow, rte.method)
+			continue
+		}
+		if score > bestScore {
+			best, bestParams, bestScore = rte, params, score
+		}
+	}
+	if best == nil {
+		if len(allow) > 0 {
+			w.Header().Set("Allow", strings.Join(allow, ", "))
+			WriteError(w, NewHttpError(http.StatusMethodNotAllowed, "method not allowed"))
+			return
+		}
+		WriteError(w, NewHttpError(http.StatusNotFound, "not found"))
+		return
+	}
+	if bestParams != nil {
+		r = r.WithContext(context.WithValue(r.Context(), paramsKey{}, bestParams))
+	}
+	best.handler.ServeHTTP(w, r)
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rt.handler == nil {
+		rt.route(w, r)
+		return
+	}
+	rt.handler.ServeHTTP(w, r)
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
@@ -1,36 +1,160 @@
 package service
 
 import (
+	"context"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/zerak/ego/config"
 	"github.com/zerak/ego/net"
 )
 
+// DefaultShutdownTimeout max time waiting for sessions drained on Stop
+// unless config drain_timeout is set
+const DefaultShutdownTimeout = 10 * time.Second
+
 type DefaultTcpServer struct {
-	conf config.Server
+	conf      config.Server
+	listener  *net.TcpListener
+	workers   *net.WorkerPool
+	connector net.Connector
+	handler   func(net.Session) net.PacketHandler
 }
 
-func (t DefaultTcpServer) Name() string {
+func (t *DefaultTcpServer) Name() string {
 	return "DefaultTcpServer"
 }
 
-func (t DefaultTcpServer) Init() error {
+func (t *DefaultTcpServer) Init() error {
 	return nil
 }
 
-func (t DefaultTcpServer) Register(h interface{}) error {
+// Register accept a net.Connector or a session handler factory, see SetConnector and SetHandler
+func (t *DefaultTcpServer) Register(h interface{}) error {
+	switch h := h.(type) {
+	case net.Connector:
+		t.SetConnector(h)
+	case func(net.Session) net.PacketHandler:
+		t.SetHandler(h)
+	default:
+		return fmt.Errorf("invalid tcp connector:%T", h)
+	}
 	return nil
 }
 
-func (t DefaultTcpServer) Start() error {
+// SetConnector serve connections with c instead of the configured TcpConnector
+// the session options from config then only apply to the default one, prefer SetHandler
+func (t *DefaultTcpServer) SetConnector(c net.Connector) { t.connector = c }
+
+// SetHandler handle the frames of every session with the PacketHandler handler returns,
+// behind the rate limit, compression and dispatcher from config
+func (t *DefaultTcpServer) SetHandler(handler func(net.Session) net.PacketHandler) {
+	t.handler = handler
+}
+
+// Sessions the live connections
+func (t *DefaultTcpServer) Sessions() int {
+	if t.listener == nil {
+		return 0
+	}
+	return t.listener.Count()
+}
+
+func (t *DefaultTcpServer) Health() Status {
+	if t.listener == nil || t.listener.Closed() {
+		return Status{State: StateStopped}
+	}
+	return Status{State: StateServing, Message: fmt.Sprintf("%v sessions", t.listener.Count())}
+}
+
+func (t *DefaultTcpServer) Start() error {
+	admission, err := net.NewAdmission(net.AdmissionConfig{
+		MaxConns:      t.conf.MaxConns,
+		MaxConnsPerIP: t.conf.MaxConnsPerIP,
+		AcceptRate:    t.conf.AcceptRate,
+		AcceptBurst:   t.conf.AcceptBurst,
+		Allow:         t.conf.Allow,
+		Deny:          t.conf.Deny,
+	})
+	if err != nil {
+		return err
+	}
+	action, err := net.ParseFloodAction(t.conf.FloodAction)
+	if err != nil {
+		return err
+	}
 	connector := net.NewTcpConnector()
-	listener := net.NewTcpListener()
-	return listener.ListenAndServe(t.conf.Addr, connector, true)
+	connector.SetHandler(t.handler)
+	connector.SetRateLimit(net.RateLimit{
+		FramesPerSecond: t.conf.MaxFrames,
+		BytesPerSecond:  t.conf.MaxBytes,
+		Action:          action,
+	})
+	connector.SetCompression(net.CompressionPolicy{
+		Allowed:   t.conf.Compress,
+		Threshold: t.conf.CompressThreshold,
+	})
+	mode, err := net.ParseDispatchMode(t.conf.Dispatch)
+	if err != nil {
+		return err
+	}
+	switch mode {
+	case net.DispatchSession:
+		connector.SetDispatcher(func() net.Dispatcher {
+			return net.NewSessionQueue(t.conf.DispatchQueue)
+		}, nil)
+	case net.DispatchPool, net.DispatchLoop:
+		if mode == net.DispatchPool {
+			t.workers = net.NewWorkerPool(t.conf.DispatchWorkers, t.conf.DispatchQueue)
+		} else {
+			t.workers = net.NewLogicLoop(t.conf.DispatchQueue)
+		}
+		connector.SetDispatcher(func() net.Dispatcher { return t.workers }, nil)
+	}
+	t.listener = net.NewTcpListener()
+	opts := net.DefaultTcpOptions()
+	if t.conf.Network != "" {
+		opts.Network = t.conf.Network
+	}
+	opts.NoDelay = !t.conf.TcpDelay
+	opts.KeepAlive = t.conf.KeepAlive
+	opts.ReadBuffer = t.conf.ReadBuffer
+	opts.WriteBuffer = t.conf.WriteBuffer
+	opts.ReusePort = t.conf.ReusePort
+	t.listener.SetOptions(opts)
+	if t.conf.ProxyProtocol {
+		proxy, err := net.NewProxyProtocol(net.ProxyConfig{
+			Trusted: t.conf.ProxyTrusted,
+			Timeout: t.conf.ProxyTimeout,
+		})
+		if err != nil {
+			return err
+		}
+		t.listener.SetProxyProtocol(proxy)
+	}
+	t.listener.SetAdmission(admission)
+	if t.connector != nil {
+		return t.listener.ListenAndServe(t.conf.Addr, t.connector, true)
+	}
+	return t.listener.ListenAndServe(t.conf.Addr, connector, true)
 }
 
-func (t DefaultTcpServer) Stop(group *sync.WaitGroup) {
-	group.Done()
+func (t *DefaultTcpServer) Stop(group *sync.WaitGroup) {
+	defer group.Done()
+	if t.listener == nil {
+		return
+	}
+	timeout := t.conf.DrainTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	t.listener.Shutdown(ctx)
+	if t.workers != nil {
+		t.workers.Close()
+	}
 }
 
 type DefaultRpcServer struct {
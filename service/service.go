@@ -1,13 +1,9 @@
 package service
 
 import (
-	"flag"
-	"os"
 	"sync"
 
-	"github.com/zerak/ego/config"
 	"github.com/zerak/ego/log"
-	"github.com/zerak/ego/signal"
 )
 
 type Servicer interface {
@@ -28,44 +24,15 @@ type Servicer interface {
 	Stop(*sync.WaitGroup)
 }
 
-func init() {
-	// 1 init config module
-	confFile := flag.String("c", "./conf/default.conf", " default config file path")
-	flag.Parse()
-	config.Init(*confFile)
-
-	// 2 init log module
-	log.Init()
-}
-
+// Run the old entry: parse -c, load config.Opt, init log and run services
+// prefer NewApp, which does nothing implicitly
 func Run(services ...Servicer) {
-	log.Info("run services")
-	for _, s := range services {
-		err := s.Init()
-		if err != nil {
-			log.Fatal("service:%v init err:%v", s.Name(), err)
-		}
-		log.Info("service:%v init ok", s.Name())
+	app, err := NewApp(WithFlags(), WithServices(services...))
+	if err != nil {
+		log.Fatal("%v", err)
+		return
 	}
-
-	for _, s := range services {
-		err := s.Start()
-		if err != nil {
-			log.Fatal("service:%v start err:%v", s.Name(), err)
-		}
-		log.Info("service:%v start ok:%v", s.Name(), err)
-	}
-
-	// wait signal
-	// Ctrl+C or kill -p
-	signal.Wait(os.Interrupt)
-
-	var wg sync.WaitGroup
-	for _, s := range services {
-		wg.Add(1)
-		s.Stop(&wg)
-		log.Info("service:%v stop", s.Name())
+	if err := app.Run(); err != nil {
+		log.Fatal("%v", err)
 	}
-	wg.Wait()
-	log.Info("all services exit")
 }
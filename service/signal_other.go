@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package service
+
+import (
+	"os"
+)
+
+// signals App.Run handles, nil when the platform has none
+var (
+	stopSignals   = []os.Signal{os.Interrupt}
+	reloadSignal  os.Signal
+	reopenSignal  os.Signal
+	restartSignal os.Signal
+)
@@ -0,0 +1,17 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package service
+
+import (
+	"os"
+	"syscall"
+)
+
+// signals App.Run handles, nil when the platform has none
+var (
+	stopSignals   = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	reloadSignal  = os.Signal(syscall.SIGHUP)
+	reopenSignal  = os.Signal(syscall.SIGUSR1)
+	restartSignal = os.Signal(syscall.SIGUSR2)
+)
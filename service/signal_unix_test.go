@@ -0,0 +1,100 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package service
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/zerak/ego/config"
+	"github.com/zerak/ego/signal"
+)
+
+type reloadService struct {
+	fakeService
+	reloads int32
+}
+
+func (r *reloadService) Reload(conf config.Server) error {
+	atomic.AddInt32(&r.reloads, 1)
+	return nil
+}
+
+func TestSignals(t *testing.T) {
+	n := signal.NewNotifier(0)
+	app, err := NewApp(WithConfig(config.Server{}), WithoutLog(), WithSignals(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	rs := &reloadService{fakeService: fakeService{name: "reload", log: &got, block: 300 * time.Millisecond}}
+	app.Add(rs)
+	forced := make(chan struct{}, 1)
+	app.Lifecycle().OnForceExit = func() { forced <- struct{}{} }
+
+	done := make(chan error, 1)
+	go func() { done <- app.Run() }()
+
+	n.Inject(syscall.SIGHUP)
+	n.Inject(syscall.SIGUSR1)
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&rs.reloads) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&rs.reloads) != 1 {
+		t.Fatalf("reloads %v", rs.reloads)
+	}
+
+	// the second interrupt arrives while the service is still stopping
+	n.Inject(syscall.SIGTERM)
+	n.Inject(os.Interrupt)
+	select {
+	case <-forced:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no force exit on second interrupt")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("run not stopped on SIGTERM")
+	}
+	if len(got) != 2 || got[1] != "stop reload" {
+		t.Errorf("services %v", got)
+	}
+}
+
+func TestSignalWhileStarting(t *testing.T) {
+	n := signal.NewNotifier(0)
+	app, err := NewApp(WithConfig(config.Server{}), WithoutLog(), WithSignals(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	app.Add(&fakeService{name: "db", log: &got})
+	app.Add(&fakeService{name: "slow", startBlock: 400 * time.Millisecond, log: &got})
+
+	done := make(chan error, 1)
+	go func() { done <- app.Run() }()
+	time.Sleep(100 * time.Millisecond)
+	n.Inject(syscall.SIGTERM)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("run err %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("run not stopped on SIGTERM while starting")
+	}
+	// the start in progress is waited for then everything rolled back
+	if s := fmt.Sprint(got); s != "[start db start slow stop slow stop db]" {
+		t.Errorf("services %v", s)
+	}
+}
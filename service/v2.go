@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/zerak/ego/net"
+)
+
+type State int32
+
+const (
+	StateStopped State = iota
+	StateStarting
+	StateServing
+	StateDegraded
+	StateStopping
+)
+
+func (s State) String() string {
+	switch s {
+	case StateStopped:
+		return "stopped"
+	case StateStarting:
+		return "starting"
+	case StateServing:
+		return "serving"
+	case StateDegraded:
+		return "degraded"
+	case StateStopping:
+		return "stopping"
+	}
+	return fmt.Sprintf("State(%d)", int32(s))
+}
+
+// Status health of a service
+type Status struct {
+	State   State
+	Message string
+}
+
+func (s Status) Healthy() bool { return s.State == StateServing }
+
+func (s Status) String() string {
+	if s.Message == "" {
+		return s.State.String()
+	}
+	return s.State.String() + ":" + s.Message
+}
+
+// Service the context aware successor of Servicer
+// a Service may also implement Init() error, run before any service starts
+type Service interface {
+	Name() string
+
+	// Start start the service no blocking, ctx bounds the start only
+	Start(ctx context.Context) error
+
+	// Stop wait for all job done or ctx done
+	Stop(ctx context.Context) error
+
+	Health() Status
+}
+
+// ConnectorRegistrar typed registration of stream services
+type ConnectorRegistrar interface {
+	SetConnector(c net.Connector)
+	SetHandler(handler func(net.Session) net.PacketHandler)
+}
+
+// HandlerRegistrar typed registration of http services
+type HandlerRegistrar interface {
+	Handle(pattern string, h http.Handler)
+}
+
+// servicerAdapter run a Servicer as a Service during migration
+type servicerAdapter struct {
+	s     Servicer
+	state int32
+}
+
+// Adapt wrap a Servicer into a Service
+func Adapt(s Servicer) Service {
+	return &servicerAdapter{s: s}
+}
+
+func (a *servicerAdapter) Name() string       { return a.s.Name() }
+func (a *servicerAdapter) Init() error        { return a.s.Init() }
+func (a *servicerAdapter) Servicer() Servicer { return a.s }
+func (a *servicerAdapter) setState(s State)   { atomic.StoreInt32(&a.state, int32(s)) }
+
+// Start the Servicer has no context, a Lifecycle abandons it at the phase deadline
+func (a *servicerAdapter) Start(ctx context.Context) error {
+	a.setState(StateStarting)
+	if err := a.s.Start(); err != nil {
+		a.setState(StateStopped)
+		return err
+	}
+	a.setState(StateServing)
+	return nil
+}
+
+// Stop the Servicer has no context, a Lifecycle abandons it at the phase deadline
+func (a *servicerAdapter) Stop(ctx context.Context) error {
+	a.setState(StateStopping)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	a.s.Stop(&wg)
+	wg.Wait()
+	a.setState(StateStopped)
+	return nil
+}
+
+// Health of the Servicer when it reports one, otherwise its lifecycle state
+func (a *servicerAdapter) Health() Status {
+	if h, ok := a.s.(interface{ Health() Status }); ok {
+		return h.Health()
+	}
+	return Status{State: State(atomic.LoadInt32(&a.state))}
+}
+
+var (
+	_ ConnectorRegistrar = (*DefaultTcpServer)(nil)
+	_ HandlerRegistrar   = (*DefaultHttpServer)(nil)
+)
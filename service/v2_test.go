@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/zerak/ego/config"
+	"github.com/zerak/ego/net"
+)
+
+type degradedService struct {
+	fakeService
+}
+
+func (d *degradedService) Health() Status { return Status{State: StateDegraded, Message: "lag"} }
+
+func TestServicerAdapter(t *testing.T) {
+	var got []string
+	ctx := context.Background()
+	a := Adapt(&fakeService{name: "db", log: &got})
+	if a.Name() != "db" || a.Health().State != StateStopped {
+		t.Errorf("name %v health %v", a.Name(), a.Health())
+	}
+	if err := a.Start(ctx); err != nil || !a.Health().Healthy() {
+		t.Errorf("start err %v health %v", err, a.Health())
+	}
+	if err := a.Stop(ctx); err != nil || a.Health().State != StateStopped {
+		t.Errorf("stop err %v health %v", err, a.Health())
+	}
+	if s := fmt.Sprint(got); s != "[start db stop db]" {
+		t.Errorf("got %v", s)
+	}
+
+	errStart := errors.New("bind failed")
+	a = Adapt(&fakeService{name: "gate", err: errStart, log: &got})
+	if err := a.Start(ctx); err != errStart || a.Health().State != StateStopped {
+		t.Errorf("start err %v health %v", err, a.Health())
+	}
+
+	// a Servicer reporting its own health
+	d := &degradedService{fakeService{name: "cache", log: &got}}
+	a = Adapt(d)
+	if h := a.Health(); h.String() != "degraded:lag" {
+		t.Errorf("health %v", h)
+	}
+	if s := a.(*servicerAdapter).Servicer(); s != d {
+		t.Errorf("adapted %v", s)
+	}
+}
+
+func TestLifecycleHealth(t *testing.T) {
+	var got []string
+	lc := NewLifecycle()
+	lc.Add(&fakeService{name: "db", log: &got})
+	lc.AddService(Adapt(&degradedService{fakeService{name: "cache", log: &got}}), "db")
+	if err := lc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	h := lc.Health()
+	if !h["db"].Healthy() || h["cache"].State != StateDegraded {
+		t.Errorf("health %v", h)
+	}
+	lc.Stop()
+	if h := lc.Health(); h["db"].State != StateStopped {
+		t.Errorf("health after stop %v", h)
+	}
+}
+
+func TestConnectorRegistrar(t *testing.T) {
+	s := NewTcp(config.Server{})
+	var r ConnectorRegistrar = s
+	c := net.NewTcpConnector()
+	r.SetConnector(c)
+	if s.connector != c {
+		t.Error("connector not set")
+	}
+	if err := s.Register("not a connector"); err == nil {
+		t.Error("invalid connector registered")
+	}
+	if err := s.Register(c); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,52 +1,276 @@
 package signal
 
 import (
+	"context"
+	"errors"
 	"os"
 	"os/signal"
 	"sync"
 )
 
+// Handler handle a signal, returning true stops the Notifier
 type Handler func(os.Signal) bool
 
-var (
+// DefaultBuffer signals queued while a handler runs
+const DefaultBuffer = 16
+
+var ErrRunning = errors.New("signal notifier already running")
+
+type handler struct {
+	id       uint64
+	priority int
+	fn       Handler
+}
+
+// Notifier catch signals while running and call their handlers in its goroutine
+// handlers can be registered and unregistered at any time,
+// a signal is caught as long as it has a handler
+// several Notifiers catching the same signal each get it
+type Notifier struct {
 	mu       sync.Mutex
-	handlers = map[os.Signal][]Handler{}
-	sigChan  = make(chan os.Signal)
-)
+	handlers map[os.Signal][]*handler
+	caught   map[os.Signal]chan os.Signal
+	nextID   uint64
+	running  bool
+	stop     chan struct{}
+	stopped  bool
 
-func Register(sig os.Signal, handler Handler) {
-	mu.Lock()
-	defer mu.Unlock()
-	if g, ok := handlers[sig]; ok {
-		handlers[sig] = append(g, handler)
-	} else {
-		handlers[sig] = []Handler{handler}
+	ch chan os.Signal
+}
+
+// NewNotifier buffer signals queued while handlers run, 0 means DefaultBuffer
+func NewNotifier(buffer int) *Notifier {
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+	return &Notifier{
+		handlers: make(map[os.Signal][]*handler),
+		caught:   make(map[os.Signal]chan os.Signal),
+		ch:       make(chan os.Signal, buffer),
 	}
 }
 
-func Listen() {
-	signals := make([]os.Signal, 0, len(handlers))
-	for sig, _ := range handlers {
-		signals = append(signals, sig)
+// Register call h on sig, see RegisterPriority
+func (n *Notifier) Register(sig os.Signal, h Handler) (unregister func()) {
+	return n.RegisterPriority(sig, 0, h)
+}
+
+// RegisterPriority call h on sig before the handlers of lower priority,
+// handlers of the same priority are called in the order registered
+// the returned func unregisters h
+func (n *Notifier) RegisterPriority(sig os.Signal, priority int, h Handler) (unregister func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nextID++
+	e := &handler{id: n.nextID, priority: priority, fn: h}
+	g := n.handlers[sig]
+	i := len(g)
+	for i > 0 && g[i-1].priority < priority {
+		i--
+	}
+	g = append(g, nil)
+	copy(g[i+1:], g[i:])
+	g[i] = e
+	n.handlers[sig] = g
+	if n.running {
+		n.catch(sig)
+	}
+	return func() { n.remove(sig, e.id) }
+}
+
+func (n *Notifier) remove(sig os.Signal, id uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	g := n.handlers[sig]
+	for i, e := range g {
+		if e.id == id {
+			g = append(g[:i:i], g[i+1:]...)
+			break
+		}
+	}
+	if len(g) > 0 {
+		n.handlers[sig] = g
+		return
+	}
+	delete(n.handlers, sig)
+	n.release(sig)
+}
+
+// Unregister every handler of sig, it is no longer caught
+func (n *Notifier) Unregister(sig os.Signal) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.handlers, sig)
+	n.release(sig)
+}
+
+// Reset unregister every handler
+func (n *Notifier) Reset() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for sig := range n.handlers {
+		delete(n.handlers, sig)
+		n.release(sig)
+	}
+}
+
+// catch forward sig to the buffer, under mu while running
+func (n *Notifier) catch(sig os.Signal) {
+	if _, ok := n.caught[sig]; ok {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sig)
+	n.caught[sig] = c
+	stop := n.stop
+	go func() {
+		for s := range c {
+			select {
+			case n.ch <- s:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// release stop catching sig, under mu
+func (n *Notifier) release(sig os.Signal) {
+	c, ok := n.caught[sig]
+	if !ok {
+		return
+	}
+	signal.Stop(c)
+	close(c)
+	delete(n.caught, sig)
+}
+
+// Inject deliver sig as if it was caught, e.g. to test shutdown
+// it blocks while the buffer is full and is handled once running
+func (n *Notifier) Inject(sig os.Signal) {
+	n.ch <- sig
+}
+
+func (n *Notifier) start() (chan struct{}, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.running {
+		return nil, ErrRunning
+	}
+	n.running = true
+	n.stop = make(chan struct{})
+	for sig := range n.handlers {
+		n.catch(sig)
+	}
+	return n.stop, nil
+}
+
+// closeStop make the loop and forwarders return, under mu
+func (n *Notifier) closeStop() {
+	if n.stop != nil && !n.stopped {
+		close(n.stop)
+		n.stopped = true
 	}
-	signal.Notify(sigChan, signals...)
+}
+
+func (n *Notifier) finish() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for sig := range n.caught {
+		n.release(sig)
+	}
+	n.closeStop()
+	n.stop = nil
+	n.stopped = false
+	n.running = false
+}
+
+// dispatch call the handlers of sig, true when one stops the Notifier
+func (n *Notifier) dispatch(sig os.Signal) bool {
+	n.mu.Lock()
+	g := append([]*handler(nil), n.handlers[sig]...)
+	n.mu.Unlock()
+	for _, h := range g {
+		if h.fn(sig) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Notifier) loop(ctx context.Context, stop <-chan struct{}) error {
+	defer n.finish()
 	for {
 		select {
-		case sig := <-sigChan:
-			mu.Lock()
-			g, ok := handlers[sig]
-			mu.Unlock()
-			if ok {
-				for _, h := range g {
-					if h(sig) {
-						return
-					}
-				}
+		case sig := <-n.ch:
+			if n.dispatch(sig) {
+				return nil
 			}
+		case <-stop:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
 
+// Run catch the registered signals and call their handlers
+// until one of them returns true, Stop or ctx done
+func (n *Notifier) Run(ctx context.Context) error {
+	stop, err := n.start()
+	if err != nil {
+		return err
+	}
+	return n.loop(ctx, stop)
+}
+
+// Start Run in a new goroutine, the signals are already caught when it returns
+func (n *Notifier) Start(ctx context.Context) error {
+	stop, err := n.start()
+	if err != nil {
+		return err
+	}
+	go n.loop(ctx, stop)
+	return nil
+}
+
+// Stop make a running Run return, the handlers stay registered
+func (n *Notifier) Stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.closeStop()
+}
+
+// Running whether Run is catching signals
+func (n *Notifier) Running() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.running
+}
+
+// Default the Notifier of the package functions
+var Default = NewNotifier(0)
+
+func Register(sig os.Signal, handler Handler) (unregister func()) {
+	return Default.Register(sig, handler)
+}
+
+// Reset unregister every handler of Default and make a running Listen return
+func Reset() {
+	Default.Reset()
+	Default.Stop()
+}
+
+// Listen run Default until a handler returns true or Reset
+func Listen() {
+	Default.Run(context.Background())
+}
+
+// Start Listen in a new goroutine, the signals are already caught when it returns
+func Start() {
+	Default.Start(context.Background())
+}
+
 func Wait(sig os.Signal) {
 	Register(sig, func(os.Signal) bool {
 		return true
@@ -0,0 +1,91 @@
+package signal
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNotifierPriority(t *testing.T) {
+	n := NewNotifier(0)
+	var order []int
+	add := func(priority, v int, stop bool) func() {
+		return n.RegisterPriority(os.Interrupt, priority, func(os.Signal) bool {
+			order = append(order, v)
+			return stop
+		})
+	}
+	add(0, 1, false)
+	add(10, 2, false)
+	remove := add(0, 3, false)
+	add(0, 4, true)
+	add(-1, 5, false)
+	remove()
+
+	n.Inject(os.Interrupt)
+	if err := n.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 3 || order[0] != 2 || order[1] != 1 || order[2] != 4 {
+		t.Errorf("order %v", order)
+	}
+	if n.Running() {
+		t.Error("running after a handler stopped it")
+	}
+}
+
+func TestNotifierStop(t *testing.T) {
+	n := NewNotifier(1)
+	got := make(chan os.Signal, 4)
+	n.Register(os.Interrupt, func(sig os.Signal) bool {
+		got <- sig
+		return false
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	if err := n.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Start(ctx); err != ErrRunning {
+		t.Errorf("second start err %v", err)
+	}
+	go func() { done <- n.Run(context.Background()) }()
+	if err := <-done; err != ErrRunning {
+		t.Errorf("run while started err %v", err)
+	}
+
+	// signals queued while a handler runs are all handled
+	for i := 0; i < 3; i++ {
+		n.Inject(os.Interrupt)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-got:
+		case <-time.After(time.Second):
+			t.Fatalf("handled %v of 3", i)
+		}
+	}
+	cancel()
+	for deadline := time.Now().Add(time.Second); n.Running(); {
+		if time.Now().After(deadline) {
+			t.Fatal("running after ctx cancel")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	go func() { done <- n.Run(context.Background()) }()
+	for !n.Running() {
+		time.Sleep(time.Millisecond)
+	}
+	n.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run after stop err %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("run after stop")
+	}
+}
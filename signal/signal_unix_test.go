@@ -0,0 +1,45 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package signal
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNotifierCatch(t *testing.T) {
+	n := NewNotifier(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := n.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// registered while running, SIGWINCH is ignored when not caught
+	got := make(chan os.Signal, 1)
+	unregister := n.Register(syscall.SIGWINCH, func(sig os.Signal) bool {
+		got <- sig
+		return false
+	})
+	syscall.Kill(syscall.Getpid(), syscall.SIGWINCH)
+	select {
+	case sig := <-got:
+		if sig != syscall.SIGWINCH {
+			t.Errorf("got %v", sig)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("signal registered while running not caught")
+	}
+
+	unregister()
+	syscall.Kill(syscall.Getpid(), syscall.SIGWINCH)
+	select {
+	case sig := <-got:
+		t.Errorf("got %v after unregister", sig)
+	case <-time.After(100 * time.Millisecond):
+	}
+}